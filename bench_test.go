@@ -0,0 +1,85 @@
+package libp2pquic
+
+import (
+	"context"
+	"crypto/rand"
+	"testing"
+
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	tpt "github.com/libp2p/go-libp2p-core/transport"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func newBenchmarkTransport(b *testing.B) (tpt.Transport, peer.ID) {
+	key, _, err := ic.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		b.Fatal(err)
+	}
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		b.Fatal(err)
+	}
+	t, err := NewTransport(key)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return t, id
+}
+
+func benchmarkListen(b *testing.B, t tpt.Transport) tpt.Listener {
+	addr, err := ma.NewMultiaddr("/ip4/127.0.0.1/udp/0/quic")
+	if err != nil {
+		b.Fatal(err)
+	}
+	ln, err := t.Listen(addr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return ln
+}
+
+// benchmarkDial measures the time it takes to dial a connection and accept it on the server side.
+// If clientListens is set, the client transport listens as well, so dials reuse the listener's UDP socket.
+// Otherwise, the client dials from a socket created by the reuse when dialing the first connection.
+func benchmarkDial(b *testing.B, clientListens bool) {
+	serverTransport, serverID := newBenchmarkTransport(b)
+	defer serverTransport.(*transport).Close()
+	ln := benchmarkListen(b, serverTransport)
+	defer ln.Close()
+
+	clientTransport, _ := newBenchmarkTransport(b)
+	defer clientTransport.(*transport).Close()
+	if clientListens {
+		cln := benchmarkListen(b, clientTransport)
+		defer cln.Close()
+	}
+
+	b.ReportAllocs()
+	// don't measure closing the transports and listeners
+	defer b.StopTimer()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+		if err != nil {
+			b.Fatal(err)
+		}
+		sconn, err := ln.Accept()
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.StopTimer()
+		conn.Close()
+		sconn.Close()
+		b.StartTimer()
+	}
+}
+
+func BenchmarkDial_WithListener(b *testing.B) {
+	benchmarkDial(b, true)
+}
+
+func BenchmarkDial_WithoutListener(b *testing.B) {
+	benchmarkDial(b, false)
+}
@@ -1,10 +1,19 @@
 package libp2pquic
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
 
 	ic "github.com/libp2p/go-libp2p-core/crypto"
 	"github.com/libp2p/go-libp2p-core/mux"
+	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
 	tpt "github.com/libp2p/go-libp2p-core/transport"
 
@@ -12,10 +21,58 @@ import (
 	ma "github.com/multiformats/go-multiaddr"
 )
 
+// ErrStreamLimitReached is returned by TryOpenStream when a stream can't be opened,
+// because the peer's stream limit is reached.
+var ErrStreamLimitReached = errors.New("stream limit reached")
+
+// ErrConnDraining is returned when opening a stream on a connection that is being drained.
+var ErrConnDraining = errors.New("connection is draining")
+
+var connCounter uint64
+
+// newConnID returns an identifier that is unique for all connections in this process.
+func newConnID() string {
+	return strconv.FormatUint(atomic.AddUint64(&connCounter, 1), 10)
+}
+
+// A QUICConn is a tpt.CapableConn running over a QUIC session.
+//
+// The multiaddrs returned by LocalMultiaddr and RemoteMultiaddr are QUIC multiaddrs
+// of the form /ip4/<ip>/udp/<port>/quic (or /ip6/...). The local multiaddr contains
+// the port of the UDP socket the connection is using.
+type QUICConn interface {
+	tpt.CapableConn
+
+	// OpenStreamSync opens a new stream, blocking until the peer's stream limit allows it.
+	OpenStreamSync(ctx context.Context) (mux.MuxedStream, error)
+	// TryOpenStream opens a new stream, if the peer's stream limit allows it.
+	// Otherwise, it returns ErrStreamLimitReached.
+	TryOpenStream() (mux.MuxedStream, error)
+	// OpenUniStream opens a new unidirectional stream.
+	OpenUniStream(ctx context.Context) (io.WriteCloser, error)
+	// AcceptUniStream accepts a unidirectional stream opened by the other side.
+	AcceptUniStream(ctx context.Context) (io.ReadCloser, error)
+	// Reset closes the connection abruptly.
+	Reset() error
+	// WriteStream opens a new stream, writes all data read from r to it, and closes it.
+	WriteStream(ctx context.Context, r io.Reader) (int64, error)
+	// WriteStreamAsync opens a new stream, writes data to it, and closes it, without blocking.
+	WriteStreamAsync(ctx context.Context, data []byte) <-chan error
+	// StreamCount returns the number of streams that were opened or accepted, and weren't closed or reset yet.
+	StreamCount() int
+	// CloseStream resets the stream with the given stream ID.
+	CloseStream(streamID uint64) error
+}
+
 type conn struct {
+	id        string
 	sess      quic.Session
 	transport tpt.Transport
 
+	streamObserver    StreamObserver
+	streamErrorMapper func(error) error
+	countStreams      func(delta int) // called with +1 / -1 when a stream is added / removed, if set
+
 	localPeer      peer.ID
 	privKey        ic.PrivKey
 	localMultiaddr ma.Multiaddr
@@ -23,29 +80,265 @@ type conn struct {
 	remotePeerID    peer.ID
 	remotePubKey    ic.PubKey
 	remoteMultiaddr ma.Multiaddr
+
+	resetOnce sync.Once
+	resetErr  error
+
+	streamsMutex sync.Mutex
+	numStreams   int // number of streams that weren't closed or reset yet
+	streams      map[quic.StreamID]mux.MuxedStream
+	draining     bool          // set once drain is called
+	drained      chan struct{} // closed once draining, and all streams are closed or reset
 }
 
-var _ tpt.CapableConn = &conn{}
+var _ QUICConn = &conn{}
 
 func (c *conn) Close() error {
 	return c.sess.Close()
 }
 
+// Reset closes the connection abruptly, without waiting for streams to be closed.
+// It is safe to call Reset multiple times, and from multiple goroutines.
+func (c *conn) Reset() error {
+	c.resetOnce.Do(func() {
+		c.resetErr = c.sess.CloseWithError(0, "reset")
+	})
+	return c.resetErr
+}
+
 // IsClosed returns whether a connection is fully closed.
 func (c *conn) IsClosed() bool {
 	return c.sess.Context().Err() != nil
 }
 
 // OpenStream creates a new stream.
+// If the peer's stream limit is reached, it blocks until the peer allows opening a new stream.
 func (c *conn) OpenStream() (mux.MuxedStream, error) {
-	qstr, err := c.sess.OpenStreamSync(context.Background())
-	return &stream{Stream: qstr}, err
+	return c.OpenStreamSync(context.Background())
+}
+
+// TryOpenStream creates a new stream.
+// It doesn't block if the peer's stream limit is reached, but returns ErrStreamLimitReached.
+func (c *conn) TryOpenStream() (mux.MuxedStream, error) {
+	qstr, err := c.sess.OpenStream()
+	if err != nil {
+		if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+			return nil, ErrStreamLimitReached
+		}
+		return nil, err
+	}
+	return c.openedStream(qstr)
+}
+
+// OpenStreamSync creates a new stream.
+// If the peer's stream limit is reached, it blocks until the peer allows opening a new stream,
+// or until the context is canceled. In that case, the context's error is returned.
+func (c *conn) OpenStreamSync(ctx context.Context) (mux.MuxedStream, error) {
+	qstr, err := c.sess.OpenStreamSync(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return c.openedStream(qstr)
+}
+
+// openedStream sets up a stream opened by TryOpenStream or OpenStreamSync.
+// If the connection is being drained, the stream is reset, and ErrConnDraining is returned.
+func (c *conn) openedStream(qstr quic.Stream) (mux.MuxedStream, error) {
+	if !c.addStream() {
+		qstr.CancelRead(0)
+		qstr.CancelWrite(0)
+		return nil, ErrConnDraining
+	}
+	return c.newStream(qstr, network.DirOutbound), nil
+}
+
+// WriteStream opens a new stream, writes all data read from r to it, and closes it.
+// It returns the number of bytes written.
+// If the context is canceled before all data was written, the stream is reset, and the context's error is returned.
+// Note that a Read call on r that blocks isn't interrupted when the context is canceled.
+func (c *conn) WriteStream(ctx context.Context, r io.Reader) (int64, error) {
+	str, err := c.OpenStreamSync(ctx)
+	if err != nil {
+		return 0, err
+	}
+	// Nothing is ever read from the stream.
+	// Stop reading right away, so the stream is forgotten once it is closed.
+	str.(interface{ CancelRead(quic.ErrorCode) }).CancelRead(0)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			str.Reset()
+		case <-done:
+		}
+	}()
+
+	n, err := io.Copy(str, r)
+	if ctx.Err() != nil {
+		return n, ctx.Err()
+	}
+	if err != nil {
+		str.Reset()
+		return n, err
+	}
+	return n, str.Close()
+}
+
+// WriteStreamAsync opens a new stream, writes data to it, and closes it, in a new goroutine.
+// The returned channel receives the error returned by WriteStream, or nil, once the stream was written.
+// Multiple calls run concurrently, each on its own stream.
+// data must not be modified until the channel received a value.
+func (c *conn) WriteStreamAsync(ctx context.Context, data []byte) <-chan error {
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := c.WriteStream(ctx, bytes.NewReader(data))
+		errChan <- err
+	}()
+	return errChan
+}
+
+// OpenUniStream opens a new unidirectional stream.
+// The peer only accepts unidirectional streams if it enabled them using WithUnidirectionalStreams.
+func (c *conn) OpenUniStream(ctx context.Context) (io.WriteCloser, error) {
+	str, err := c.sess.OpenUniStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return str, nil
+}
+
+// AcceptUniStream accepts a unidirectional stream opened by the other side.
+func (c *conn) AcceptUniStream(ctx context.Context) (io.ReadCloser, error) {
+	str, err := c.sess.AcceptUniStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &receiveStream{ReceiveStream: str}, nil
 }
 
 // AcceptStream accepts a stream opened by the other side.
+// Once the connection is being drained, streams opened by the other side are reset.
 func (c *conn) AcceptStream() (mux.MuxedStream, error) {
-	qstr, err := c.sess.AcceptStream(context.Background())
-	return &stream{Stream: qstr}, err
+	for {
+		qstr, err := c.sess.AcceptStream(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		if !c.addStream() {
+			qstr.CancelRead(0)
+			qstr.CancelWrite(0)
+			continue
+		}
+		return c.newStream(qstr, network.DirInbound), nil
+	}
+}
+
+// addStream counts a new stream. It returns false if the connection is being drained.
+func (c *conn) addStream() bool {
+	c.streamsMutex.Lock()
+	if c.draining {
+		c.streamsMutex.Unlock()
+		return false
+	}
+	c.numStreams++
+	c.streamsMutex.Unlock()
+
+	if c.countStreams != nil {
+		c.countStreams(1)
+	}
+	return true
+}
+
+// removeStream counts a stream that was closed or reset.
+func (c *conn) removeStream() {
+	if c.countStreams != nil {
+		defer c.countStreams(-1)
+	}
+	c.streamsMutex.Lock()
+	defer c.streamsMutex.Unlock()
+
+	c.numStreams--
+	if c.draining && c.numStreams == 0 {
+		close(c.drained)
+	}
+}
+
+// StreamCount returns the number of streams that were opened or accepted, and weren't closed or reset yet.
+// Streams opened by the peer that weren't accepted yet are not counted,
+// since quic-go doesn't expose the length of its accept queue.
+func (c *conn) StreamCount() int {
+	c.streamsMutex.Lock()
+	defer c.streamsMutex.Unlock()
+	return c.numStreams
+}
+
+// forgetStream removes a stream that's finished in both directions, so it can't be closed by CloseStream any more.
+func (c *conn) forgetStream(id quic.StreamID) {
+	c.streamsMutex.Lock()
+	delete(c.streams, id)
+	c.streamsMutex.Unlock()
+}
+
+// drain stops the connection from opening and accepting new streams.
+// The returned channel is closed once all streams are closed or reset.
+func (c *conn) drain() <-chan struct{} {
+	c.streamsMutex.Lock()
+	defer c.streamsMutex.Unlock()
+
+	if !c.draining {
+		c.draining = true
+		c.drained = make(chan struct{})
+		if c.numStreams == 0 {
+			close(c.drained)
+		}
+	}
+	return c.drained
+}
+
+func (c *conn) newStream(qstr quic.Stream, dir network.Direction) mux.MuxedStream {
+	id := qstr.StreamID()
+	var str mux.MuxedStream = &stream{
+		Stream:      qstr,
+		errorMapper: c.streamErrorMapper,
+		onDone:      c.removeStream,
+		onFinished:  func() { c.forgetStream(id) },
+	}
+	if c.streamObserver != nil {
+		streamID := strconv.FormatInt(int64(id), 10)
+		c.streamObserver.OnStreamOpen(c.id, streamID, dir)
+		str = &telemetryStream{
+			stream:   str.(*stream),
+			observer: c.streamObserver,
+			connID:   c.id,
+			streamID: streamID,
+		}
+	}
+
+	c.streamsMutex.Lock()
+	if c.streams == nil {
+		c.streams = make(map[quic.StreamID]mux.MuxedStream)
+	}
+	c.streams[id] = str
+	c.streamsMutex.Unlock()
+	return str
+}
+
+// CloseStream resets the stream with the given stream ID, in both directions.
+// This is useful when the stream itself isn't at hand, e.g. in a goroutine that tracks stream timeouts.
+// It returns an error if there's no such stream, or if the stream was already reset,
+// or is finished in both directions.
+func (c *conn) CloseStream(streamID uint64) error {
+	c.streamsMutex.Lock()
+	str, ok := c.streams[quic.StreamID(streamID)]
+	c.streamsMutex.Unlock()
+	if !ok {
+		return fmt.Errorf("no open stream with ID %d", streamID)
+	}
+	return str.Reset()
 }
 
 // LocalPeer returns our peer ID
@@ -68,12 +361,12 @@ func (c *conn) RemotePublicKey() ic.PubKey {
 	return c.remotePubKey
 }
 
-// LocalMultiaddr returns the local Multiaddr associated
+// LocalMultiaddr returns the local QUIC multiaddr associated
 func (c *conn) LocalMultiaddr() ma.Multiaddr {
 	return c.localMultiaddr
 }
 
-// RemoteMultiaddr returns the remote Multiaddr associated
+// RemoteMultiaddr returns the remote QUIC multiaddr associated
 func (c *conn) RemoteMultiaddr() ma.Multiaddr {
 	return c.remoteMultiaddr
 }
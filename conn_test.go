@@ -4,20 +4,103 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	mrand "math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/golang/protobuf/proto"
 	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/mux"
+	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
 	tpt "github.com/libp2p/go-libp2p-core/transport"
+	quic "github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/quictrace"
+	"github.com/lucas-clemente/quic-go/quictrace/pb"
 	ma "github.com/multiformats/go-multiaddr"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
 
+type mockSession struct {
+	quic.Session
+	closeCount int32
+}
+
+func (s *mockSession) CloseWithError(quic.ErrorCode, string) error {
+	atomic.AddInt32(&s.closeCount, 1)
+	return errors.New("closed")
+}
+
+type streamEvent struct {
+	connID, streamID        string
+	dir                     network.Direction
+	closed                  bool
+	bytesRead, bytesWritten int64
+}
+
+type recordingStreamObserver struct {
+	mutex  sync.Mutex
+	events []streamEvent
+}
+
+func (o *recordingStreamObserver) OnStreamOpen(connID, streamID string, dir network.Direction) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.events = append(o.events, streamEvent{connID: connID, streamID: streamID, dir: dir})
+}
+
+func (o *recordingStreamObserver) OnStreamClose(connID, streamID string, bytesRead, bytesWritten int64) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.events = append(o.events, streamEvent{
+		connID:       connID,
+		streamID:     streamID,
+		closed:       true,
+		bytesRead:    bytesRead,
+		bytesWritten: bytesWritten,
+	})
+}
+
+func (o *recordingStreamObserver) Events() []streamEvent {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return append([]streamEvent{}, o.events...)
+}
+
+type countingStatsCollector struct {
+	dialed, dialErrors, accepted, handshakes int32
+	streams                                  int32 // the last stream count recorded
+}
+
+func (c *countingStatsCollector) IncrDialed()    { atomic.AddInt32(&c.dialed, 1) }
+func (c *countingStatsCollector) IncrDialError() { atomic.AddInt32(&c.dialErrors, 1) }
+func (c *countingStatsCollector) IncrAccepted()  { atomic.AddInt32(&c.accepted, 1) }
+func (c *countingStatsCollector) RecordHandshakeDuration(d time.Duration) {
+	if d > 0 {
+		atomic.AddInt32(&c.handshakes, 1)
+	}
+}
+func (c *countingStatsCollector) RecordStreamCount(n int) { atomic.StoreInt32(&c.streams, int32(n)) }
+
+// An infiniteReader returns an infinite stream of zeros.
+type infiniteReader struct{}
+
+func (infiniteReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+
 var _ = Describe("Connection", func() {
 	var (
 		serverKey, clientKey ic.PrivKey
@@ -62,12 +145,12 @@ var _ = Describe("Connection", func() {
 	})
 
 	It("handshakes on IPv4", func() {
-		serverTransport, err := NewTransport(serverKey)
+		serverTransport, err := NewTransport(serverKey, WithGarbageCollectInterval(testGarbageCollectInterval))
 		Expect(err).ToNot(HaveOccurred())
 		ln := runServer(serverTransport, "/ip4/127.0.0.1/udp/0/quic")
 		defer ln.Close()
 
-		clientTransport, err := NewTransport(clientKey)
+		clientTransport, err := NewTransport(clientKey, WithGarbageCollectInterval(testGarbageCollectInterval))
 		Expect(err).ToNot(HaveOccurred())
 		conn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
 		Expect(err).ToNot(HaveOccurred())
@@ -86,12 +169,12 @@ var _ = Describe("Connection", func() {
 	})
 
 	It("handshakes on IPv6", func() {
-		serverTransport, err := NewTransport(serverKey)
+		serverTransport, err := NewTransport(serverKey, WithGarbageCollectInterval(testGarbageCollectInterval))
 		Expect(err).ToNot(HaveOccurred())
 		ln := runServer(serverTransport, "/ip6/::1/udp/0/quic")
 		defer ln.Close()
 
-		clientTransport, err := NewTransport(clientKey)
+		clientTransport, err := NewTransport(clientKey, WithGarbageCollectInterval(testGarbageCollectInterval))
 		Expect(err).ToNot(HaveOccurred())
 		conn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
 		Expect(err).ToNot(HaveOccurred())
@@ -109,13 +192,114 @@ var _ = Describe("Connection", func() {
 		Expect(serverConn.RemotePublicKey()).To(Equal(clientKey.GetPublic()))
 	})
 
+	It("dials from the source port set on the context", func() {
+		serverTransport, err := NewTransport(serverKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+		Expect(err).ToNot(HaveOccurred())
+		ln := runServer(serverTransport, "/ip4/127.0.0.1/udp/0/quic")
+		defer ln.Close()
+
+		// find a free port
+		udpConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+		Expect(err).ToNot(HaveOccurred())
+		port := udpConn.LocalAddr().(*net.UDPAddr).Port
+		Expect(udpConn.Close()).To(Succeed())
+
+		clientTransport, err := NewTransport(clientKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+		Expect(err).ToNot(HaveOccurred())
+		conn, err := clientTransport.Dial(WithSourcePort(context.Background(), port), ln.Multiaddr(), serverID)
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		serverConn, err := ln.Accept()
+		Expect(err).ToNot(HaveOccurred())
+		defer serverConn.Close()
+
+		localPort, err := conn.LocalMultiaddr().ValueForProtocol(ma.P_UDP)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(localPort).To(Equal(strconv.Itoa(port)))
+		remotePort, err := serverConn.RemoteMultiaddr().ValueForProtocol(ma.P_UDP)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(remotePort).To(Equal(strconv.Itoa(port)))
+	})
+
+	It("traces the phases of a dial", func() {
+		serverTransport, err := NewTransport(serverKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+		Expect(err).ToNot(HaveOccurred())
+		ln := runServer(serverTransport, "/ip4/127.0.0.1/udp/0/quic")
+		defer ln.Close()
+
+		clientTransport, err := NewTransport(clientKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+		Expect(err).ToNot(HaveOccurred())
+		trace := &DialTrace{}
+		start := time.Now()
+		conn, err := clientTransport.Dial(WithDialTrace(context.Background(), trace), ln.Multiaddr(), serverID)
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		serverConn, err := ln.Accept()
+		Expect(err).ToNot(HaveOccurred())
+		defer serverConn.Close()
+
+		Expect(DialTraceFromContext(context.Background())).To(BeNil())
+		last := start
+		for _, t := range []time.Time{
+			trace.AddrResolved,
+			trace.SocketAcquired,
+			trace.HandshakeStarted,
+			trace.HandshakeCompleted,
+			trace.ConnReady,
+		} {
+			Expect(t.IsZero()).To(BeFalse())
+			Expect(t).To(BeTemporally(">=", last))
+			last = t
+		}
+	})
+
+	It("returns QUIC multiaddrs as local and remote addresses", func() {
+		serverTransport, err := NewTransport(serverKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+		Expect(err).ToNot(HaveOccurred())
+		ln := runServer(serverTransport, "/ip4/127.0.0.1/udp/0/quic")
+		defer ln.Close()
+
+		clientTransport, err := NewTransport(clientKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+		Expect(err).ToNot(HaveOccurred())
+		c, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+		Expect(err).ToNot(HaveOccurred())
+		defer c.Close()
+		serverConn, err := ln.Accept()
+		Expect(err).ToNot(HaveOccurred())
+		defer serverConn.Close()
+
+		checkAddr := func(addr ma.Multiaddr) (ip, port string) {
+			protos := addr.Protocols()
+			Expect(protos).To(HaveLen(3))
+			Expect(protos[0].Code).To(Equal(ma.P_IP4))
+			Expect(protos[1].Code).To(Equal(ma.P_UDP))
+			Expect(protos[2].Code).To(Equal(ma.P_QUIC))
+			ip, err := addr.ValueForProtocol(ma.P_IP4)
+			Expect(err).ToNot(HaveOccurred())
+			port, err = addr.ValueForProtocol(ma.P_UDP)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(port).ToNot(Equal("0"))
+			return ip, port
+		}
+		clientConn := c.(QUICConn)
+		_, serverPort := checkAddr(clientConn.RemoteMultiaddr())
+		Expect(clientConn.RemoteMultiaddr()).To(Equal(ln.Multiaddr()))
+		_, clientPort := checkAddr(clientConn.LocalMultiaddr())
+		ip, port := checkAddr(serverConn.(QUICConn).LocalMultiaddr())
+		Expect(ip).To(Equal("127.0.0.1"))
+		Expect(port).To(Equal(serverPort))
+		ip, port = checkAddr(serverConn.(QUICConn).RemoteMultiaddr())
+		Expect(ip).To(Equal("127.0.0.1"))
+		Expect(port).To(Equal(clientPort))
+	})
+
 	It("opens and accepts streams", func() {
-		serverTransport, err := NewTransport(serverKey)
+		serverTransport, err := NewTransport(serverKey, WithGarbageCollectInterval(testGarbageCollectInterval))
 		Expect(err).ToNot(HaveOccurred())
 		ln := runServer(serverTransport, "/ip4/127.0.0.1/udp/0/quic")
 		defer ln.Close()
 
-		clientTransport, err := NewTransport(clientKey)
+		clientTransport, err := NewTransport(clientKey, WithGarbageCollectInterval(testGarbageCollectInterval))
 		Expect(err).ToNot(HaveOccurred())
 		conn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
 		Expect(err).ToNot(HaveOccurred())
@@ -136,89 +320,1517 @@ var _ = Describe("Connection", func() {
 		Expect(data).To(Equal([]byte("foobar")))
 	})
 
-	It("fails if the peer ID doesn't match", func() {
-		thirdPartyID, _ := createPeer()
+	It("writes streams", func() {
+		serverTransport, err := NewTransport(serverKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+		Expect(err).ToNot(HaveOccurred())
+		ln := runServer(serverTransport, "/ip4/127.0.0.1/udp/0/quic")
+		defer ln.Close()
+
+		data := make([]byte, 10*1<<20) // 10 MB
+		rand.Read(data)
+		done := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			defer close(done)
+			conn, err := ln.Accept()
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+			str, err := conn.AcceptStream()
+			Expect(err).ToNot(HaveOccurred())
+			received, err := ioutil.ReadAll(str)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(bytes.Equal(received, data)).To(BeTrue())
+		}()
+
+		clientTransport, err := NewTransport(clientKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+		Expect(err).ToNot(HaveOccurred())
+		conn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		n, err := conn.(QUICConn).WriteStream(context.Background(), bytes.NewReader(data))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(n).To(BeEquivalentTo(len(data)))
+		Eventually(done, 10*time.Second).Should(BeClosed())
+	})
 
-		serverTransport, err := NewTransport(serverKey)
+	It("writes streams asynchronously", func() {
+		serverTransport, err := NewTransport(serverKey, WithGarbageCollectInterval(testGarbageCollectInterval))
 		Expect(err).ToNot(HaveOccurred())
 		ln := runServer(serverTransport, "/ip4/127.0.0.1/udp/0/quic")
+		defer ln.Close()
+
+		const num = 10
+		received := make(chan []byte, num)
+		go func() {
+			defer GinkgoRecover()
+			conn, err := ln.Accept()
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+			for i := 0; i < num; i++ {
+				str, err := conn.AcceptStream()
+				Expect(err).ToNot(HaveOccurred())
+				go func() {
+					defer GinkgoRecover()
+					data, err := ioutil.ReadAll(str)
+					Expect(err).ToNot(HaveOccurred())
+					received <- data
+				}()
+			}
+			// wait until the client closes the connection
+			conn.AcceptStream()
+		}()
 
-		clientTransport, err := NewTransport(clientKey)
+		clientTransport, err := NewTransport(clientKey, WithGarbageCollectInterval(testGarbageCollectInterval))
 		Expect(err).ToNot(HaveOccurred())
-		// dial, but expect the wrong peer ID
-		_, err = clientTransport.Dial(context.Background(), ln.Multiaddr(), thirdPartyID)
-		Expect(err).To(HaveOccurred())
-		Expect(err.Error()).To(ContainSubstring("CRYPTO_ERROR"))
+		conn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		var errChans []<-chan error
+		for i := 0; i < num; i++ {
+			errChans = append(errChans, conn.(QUICConn).WriteStreamAsync(context.Background(), []byte(fmt.Sprintf("stream %d", i))))
+		}
+		for _, errChan := range errChans {
+			var err error
+			Eventually(errChan, 5*time.Second).Should(Receive(&err))
+			Expect(err).ToNot(HaveOccurred())
+		}
+		var messages []string
+		for i := 0; i < num; i++ {
+			var data []byte
+			Eventually(received, 5*time.Second).Should(Receive(&data))
+			messages = append(messages, string(data))
+		}
+		for i := 0; i < num; i++ {
+			Expect(messages).To(ContainElement(fmt.Sprintf("stream %d", i)))
+		}
+	})
+
+	It("resets the stream when the context is canceled while writing a stream", func() {
+		serverTransport, err := NewTransport(serverKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+		Expect(err).ToNot(HaveOccurred())
+		ln := runServer(serverTransport, "/ip4/127.0.0.1/udp/0/quic")
+		defer ln.Close()
 
 		done := make(chan struct{})
 		go func() {
 			defer GinkgoRecover()
 			defer close(done)
-			ln.Accept()
+			conn, err := ln.Accept()
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+			str, err := conn.AcceptStream()
+			Expect(err).ToNot(HaveOccurred())
+			_, err = ioutil.ReadAll(str)
+			Expect(err).To(HaveOccurred())
 		}()
-		Consistently(done).ShouldNot(BeClosed())
-		ln.Close()
+
+		clientTransport, err := NewTransport(clientKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+		Expect(err).ToNot(HaveOccurred())
+		conn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		_, err = conn.(QUICConn).WriteStream(ctx, infiniteReader{})
+		Expect(err).To(MatchError(context.DeadlineExceeded))
 		Eventually(done).Should(BeClosed())
 	})
 
-	It("dials to two servers at the same time", func() {
-		serverID2, serverKey2 := createPeer()
-
-		serverTransport, err := NewTransport(serverKey)
-		Expect(err).ToNot(HaveOccurred())
-		ln1 := runServer(serverTransport, "/ip4/127.0.0.1/udp/0/quic")
-		serverTransport2, err := NewTransport(serverKey2)
-		defer ln1.Close()
+	It("maps stream errors", func() {
+		errCustom := errors.New("custom error")
+		serverTransport, err := NewTransport(serverKey, WithGarbageCollectInterval(testGarbageCollectInterval))
 		Expect(err).ToNot(HaveOccurred())
-		ln2 := runServer(serverTransport2, "/ip4/127.0.0.1/udp/0/quic")
-		defer ln2.Close()
+		ln := runServer(serverTransport, "/ip4/127.0.0.1/udp/0/quic")
+		defer ln.Close()
 
-		data := bytes.Repeat([]byte{'a'}, 5*1<<20) // 5 MB
-		// wait for both servers to accept a connection
-		// then send some data
 		go func() {
-			serverConn1, err := ln1.Accept()
+			defer GinkgoRecover()
+			conn, err := ln.Accept()
 			Expect(err).ToNot(HaveOccurred())
-			serverConn2, err := ln2.Accept()
+			str, err := conn.AcceptStream()
 			Expect(err).ToNot(HaveOccurred())
-
-			for _, c := range []tpt.CapableConn{serverConn1, serverConn2} {
-				go func(conn tpt.CapableConn) {
-					defer GinkgoRecover()
-					str, err := conn.OpenStream()
-					Expect(err).ToNot(HaveOccurred())
-					defer str.Close()
-					_, err = str.Write(data)
-					Expect(err).ToNot(HaveOccurred())
-				}(c)
-			}
+			str.(*stream).CancelWrite(42)
+			// wait until the client closes the connection
+			conn.AcceptStream()
 		}()
 
-		clientTransport, err := NewTransport(clientKey)
+		clientTransport, err := NewTransport(
+			clientKey,
+			WithGarbageCollectInterval(testGarbageCollectInterval),
+			WithStreamErrorMapper(func(err error) error {
+				if serr, ok := err.(quic.StreamError); ok && serr.ErrorCode() == 42 {
+					return errCustom
+				}
+				return err
+			}),
+		)
 		Expect(err).ToNot(HaveOccurred())
-		c1, err := clientTransport.Dial(context.Background(), ln1.Multiaddr(), serverID)
+		conn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
 		Expect(err).ToNot(HaveOccurred())
-		defer c1.Close()
-		c2, err := clientTransport.Dial(context.Background(), ln2.Multiaddr(), serverID2)
+		defer conn.Close()
+		str, err := conn.OpenStream()
 		Expect(err).ToNot(HaveOccurred())
-		defer c2.Close()
+		_, err = str.Write([]byte("foobar"))
+		Expect(err).ToNot(HaveOccurred())
+		_, err = ioutil.ReadAll(str)
+		Expect(err).To(MatchError(errCustom))
+	})
 
-		done := make(chan struct{}, 2)
-		// receive the data on both connections at the same time
-		for _, c := range []tpt.CapableConn{c1, c2} {
-			go func(conn tpt.CapableConn) {
+	It("reports streams to the stream observer", func() {
+		serverObserver := &recordingStreamObserver{}
+		serverTransport, err := NewTransport(serverKey, WithGarbageCollectInterval(testGarbageCollectInterval), WithStreamObserver(serverObserver))
+		Expect(err).ToNot(HaveOccurred())
+		ln := runServer(serverTransport, "/ip4/127.0.0.1/udp/0/quic")
+		defer ln.Close()
+
+		clientObserver := &recordingStreamObserver{}
+		clientTransport, err := NewTransport(clientKey, WithGarbageCollectInterval(testGarbageCollectInterval), WithStreamObserver(clientObserver))
+		Expect(err).ToNot(HaveOccurred())
+		conn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		serverConn, err := ln.Accept()
+		Expect(err).ToNot(HaveOccurred())
+		defer serverConn.Close()
+
+		data := bytes.Repeat([]byte{'a'}, 10000)
+		str, err := conn.OpenStream()
+		Expect(err).ToNot(HaveOccurred())
+		_, err = str.Write(data)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(str.Close()).To(Succeed())
+		sstr, err := serverConn.AcceptStream()
+		Expect(err).ToNot(HaveOccurred())
+		received, err := ioutil.ReadAll(sstr)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(received).To(Equal(data))
+		Expect(sstr.Close()).To(Succeed())
+
+		clientEvents := clientObserver.Events()
+		Expect(clientEvents).To(HaveLen(2))
+		Expect(clientEvents[0].dir).To(Equal(network.DirOutbound))
+		Expect(clientEvents[1].closed).To(BeTrue())
+		Expect(clientEvents[1].streamID).To(Equal(clientEvents[0].streamID))
+		Expect(clientEvents[1].bytesWritten).To(BeEquivalentTo(len(data)))
+		Expect(clientEvents[1].bytesRead).To(BeZero())
+
+		serverEvents := serverObserver.Events()
+		Expect(serverEvents).To(HaveLen(2))
+		Expect(serverEvents[0].dir).To(Equal(network.DirInbound))
+		Expect(serverEvents[1].closed).To(BeTrue())
+		Expect(serverEvents[1].streamID).To(Equal(serverEvents[0].streamID))
+		Expect(serverEvents[1].bytesRead).To(BeEquivalentTo(len(data)))
+		Expect(serverEvents[1].bytesWritten).To(BeZero())
+		Expect(serverEvents[0].connID).ToNot(Equal(clientEvents[0].connID))
+	})
+
+	It("opens and accepts unidirectional streams", func() {
+		serverTransport, err := NewTransport(serverKey, WithGarbageCollectInterval(testGarbageCollectInterval), WithUnidirectionalStreams(10))
+		Expect(err).ToNot(HaveOccurred())
+		ln := runServer(serverTransport, "/ip4/127.0.0.1/udp/0/quic")
+		defer ln.Close()
+
+		clientTransport, err := NewTransport(clientKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+		Expect(err).ToNot(HaveOccurred())
+		clientConn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+		Expect(err).ToNot(HaveOccurred())
+		defer clientConn.Close()
+		serverConn, err := ln.Accept()
+		Expect(err).ToNot(HaveOccurred())
+		defer serverConn.Close()
+
+		str, err := clientConn.(*conn).OpenUniStream(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		_, err = str.Write([]byte("foobar"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(str.Close()).To(Succeed())
+		sstr, err := serverConn.(*conn).AcceptUniStream(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		defer sstr.Close()
+		_, ok := sstr.(io.Writer)
+		Expect(ok).To(BeFalse())
+		data, err := ioutil.ReadAll(sstr)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(data).To(Equal([]byte("foobar")))
+	})
+
+	It("blocks opening streams when the peer's stream limit is reached, unless using TryOpenStream", func() {
+		serverTransport, err := NewTransport(serverKey, WithGarbageCollectInterval(testGarbageCollectInterval), WithStreamLimits(2, 0))
+		Expect(err).ToNot(HaveOccurred())
+		ln := runServer(serverTransport, "/ip4/127.0.0.1/udp/0/quic")
+		defer ln.Close()
+
+		clientTransport, err := NewTransport(clientKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+		Expect(err).ToNot(HaveOccurred())
+		clientConn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+		Expect(err).ToNot(HaveOccurred())
+		defer clientConn.Close()
+		serverConn, err := ln.Accept()
+		Expect(err).ToNot(HaveOccurred())
+		defer serverConn.Close()
+
+		qconn := clientConn.(*conn)
+		for i := 0; i < 2; i++ {
+			str, err := qconn.OpenStreamSync(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+			_, err = str.Write([]byte("foobar"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(str.Close()).To(Succeed())
+		}
+		_, err = qconn.TryOpenStream()
+		Expect(err).To(MatchError(ErrStreamLimitReached))
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		_, err = qconn.OpenStreamSync(ctx)
+		Expect(err).To(MatchError(context.DeadlineExceeded))
+
+		opened := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			defer close(opened)
+			// OpenStream blocks until the peer allows opening a new stream
+			_, err := qconn.OpenStream()
+			Expect(err).ToNot(HaveOccurred())
+		}()
+		Consistently(opened).ShouldNot(BeClosed())
+		// Accept and close one stream. This allows the client to open a new stream.
+		sstr, err := serverConn.AcceptStream()
+		Expect(err).ToNot(HaveOccurred())
+		data, err := ioutil.ReadAll(sstr)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(data).To(Equal([]byte("foobar")))
+		Expect(sstr.Close()).To(Succeed())
+		Eventually(opened).Should(BeClosed())
+	})
+
+	It("resets the session only once when Reset is called concurrently", func() {
+		sess := &mockSession{}
+		c := &conn{sess: sess}
+		var wg sync.WaitGroup
+		errChan := make(chan error, 10)
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
 				defer GinkgoRecover()
-				str, err := conn.AcceptStream()
-				Expect(err).ToNot(HaveOccurred())
-				str.Close()
-				d, err := ioutil.ReadAll(str)
-				Expect(err).ToNot(HaveOccurred())
-				Expect(d).To(Equal(data))
-				done <- struct{}{}
-			}(c)
+				defer wg.Done()
+				errChan <- c.Reset()
+			}()
 		}
+		wg.Wait()
+		close(errChan)
+		for err := range errChan {
+			Expect(err).To(MatchError("closed"))
+		}
+		Expect(atomic.LoadInt32(&sess.closeCount)).To(BeEquivalentTo(1))
+	})
 
-		Eventually(done, 5*time.Second).Should(Receive())
-		Eventually(done, 5*time.Second).Should(Receive())
+	It("tracks accepted connections by peer", func() {
+		serverTransport, err := NewTransport(serverKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+		Expect(err).ToNot(HaveOccurred())
+		ln := runServer(serverTransport, "/ip4/127.0.0.1/udp/0/quic")
+		defer ln.Close()
+
+		clientTransport, err := NewTransport(clientKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+		Expect(err).ToNot(HaveOccurred())
+		for i := 0; i < 3; i++ {
+			conn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+			serverConn, err := ln.Accept()
+			Expect(err).ToNot(HaveOccurred())
+			defer serverConn.Close()
+		}
+
+		tr := serverTransport.(*transport)
+		Expect(tr.ConnsToPeer(clientID)).To(HaveLen(3))
+		Expect(tr.ConnsToPeer(serverID)).To(BeEmpty())
+		Expect(tr.ClosePeer(clientID)).To(Succeed())
+		Eventually(func() []tpt.CapableConn { return tr.ConnsToPeer(clientID) }).Should(BeEmpty())
 	})
-})
+
+	Context("closing the transport", func() {
+		var (
+			ln                               tpt.Listener
+			serverTransport, clientTransport tpt.Transport
+			clientConns, serverConns         []tpt.CapableConn
+		)
+
+		BeforeEach(func() {
+			var err error
+			serverTransport, err = NewTransport(serverKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+			Expect(err).ToNot(HaveOccurred())
+			ln = runServer(serverTransport, "/ip4/127.0.0.1/udp/0/quic")
+
+			clientTransport, err = NewTransport(clientKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+			Expect(err).ToNot(HaveOccurred())
+			clientConns, serverConns = nil, nil
+			for i := 0; i < 3; i++ {
+				conn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+				Expect(err).ToNot(HaveOccurred())
+				clientConns = append(clientConns, conn)
+				serverConn, err := ln.Accept()
+				Expect(err).ToNot(HaveOccurred())
+				serverConns = append(serverConns, serverConn)
+			}
+		})
+
+		AfterEach(func() {
+			for _, c := range append(clientConns, serverConns...) {
+				c.Close()
+			}
+			ln.Close()
+		})
+
+		It("waits for all connections to be closed", func() {
+			errChan := make(chan error, 1)
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				errChan <- clientTransport.(*transport).CloseContext(ctx)
+			}()
+			for _, c := range clientConns {
+				Consistently(errChan, 50*time.Millisecond).ShouldNot(Receive())
+				Expect(c.Close()).To(Succeed())
+			}
+			var err error
+			Eventually(errChan).Should(Receive(&err))
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("returns the context's error if connections are still open when the context expires", func() {
+			errChan := make(chan error, 1)
+			start := time.Now()
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				defer cancel()
+				errChan <- clientTransport.(*transport).CloseContext(ctx)
+			}()
+			Expect(clientConns[0].Close()).To(Succeed())
+			Expect(clientConns[1].Close()).To(Succeed())
+			var err error
+			Eventually(errChan, 2*time.Second).Should(Receive(&err))
+			Expect(err).To(MatchError(context.DeadlineExceeded))
+			Expect(time.Since(start)).To(BeNumerically(">=", time.Second))
+		})
+
+		It("rejects new connections while waiting for connections to be closed", func() {
+			errChan := make(chan error, 2)
+			for _, tr := range []tpt.Transport{clientTransport, serverTransport} {
+				go func(tr *transport) {
+					ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+					defer cancel()
+					errChan <- tr.CloseContext(ctx)
+				}(tr.(*transport))
+			}
+			Eventually(func() error {
+				_, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+				return err
+			}).Should(MatchError(ErrTransportClosed))
+
+			// the server transport is closing, so it rejects connections from a new client
+			otherKey, _, err := ic.GenerateEd25519Key(rand.Reader)
+			Expect(err).ToNot(HaveOccurred())
+			otherTransport, err := NewTransport(otherKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+			Expect(err).ToNot(HaveOccurred())
+			defer otherTransport.(*transport).Close()
+			// Accept returns once the listener is closed in AfterEach
+			go ln.Accept()
+			conn, err := otherTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+			Expect(err).ToNot(HaveOccurred())
+			Eventually(conn.IsClosed).Should(BeTrue())
+
+			for _, c := range append(clientConns, serverConns...) {
+				Expect(c.Close()).To(Succeed())
+			}
+			Eventually(errChan).Should(Receive(BeNil()))
+			Eventually(errChan).Should(Receive(BeNil()))
+		})
+	})
+
+	It("counts streams", func() {
+		serverTransport, err := NewTransport(serverKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+		Expect(err).ToNot(HaveOccurred())
+		ln := runServer(serverTransport, "/ip4/127.0.0.1/udp/0/quic")
+		defer ln.Close()
+
+		clientTransport, err := NewTransport(clientKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+		Expect(err).ToNot(HaveOccurred())
+		clientConn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+		Expect(err).ToNot(HaveOccurred())
+		defer clientConn.Close()
+		serverConn, err := ln.Accept()
+		Expect(err).ToNot(HaveOccurred())
+		defer serverConn.Close()
+
+		for i := 0; i < 5; i++ {
+			str, err := clientConn.OpenStream()
+			Expect(err).ToNot(HaveOccurred())
+			// the server only accepts the stream once we send some data
+			_, err = str.Write([]byte("foobar"))
+			Expect(err).ToNot(HaveOccurred())
+		}
+		Expect(clientConn.(QUICConn).StreamCount()).To(Equal(5))
+
+		var accepted []mux.MuxedStream
+		for i := 0; i < 3; i++ {
+			str, err := serverConn.AcceptStream()
+			Expect(err).ToNot(HaveOccurred())
+			accepted = append(accepted, str)
+		}
+		Expect(serverConn.(QUICConn).StreamCount()).To(Equal(3))
+		Expect(accepted[0].Reset()).To(Succeed())
+		Expect(serverConn.(QUICConn).StreamCount()).To(Equal(2))
+	})
+
+	It("closes streams by their stream ID", func() {
+		serverTransport, err := NewTransport(serverKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+		Expect(err).ToNot(HaveOccurred())
+		ln := runServer(serverTransport, "/ip4/127.0.0.1/udp/0/quic")
+		defer ln.Close()
+
+		clientTransport, err := NewTransport(clientKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+		Expect(err).ToNot(HaveOccurred())
+		clientConn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+		Expect(err).ToNot(HaveOccurred())
+		defer clientConn.Close()
+		serverConn, err := ln.Accept()
+		Expect(err).ToNot(HaveOccurred())
+		defer serverConn.Close()
+
+		var strs []mux.MuxedStream
+		for i := 0; i < 3; i++ {
+			str, err := clientConn.OpenStream()
+			Expect(err).ToNot(HaveOccurred())
+			_, err = str.Write([]byte("foobar"))
+			Expect(err).ToNot(HaveOccurred())
+			strs = append(strs, str)
+		}
+		for i := 0; i < 3; i++ {
+			_, err := serverConn.AcceptStream()
+			Expect(err).ToNot(HaveOccurred())
+		}
+
+		id := strs[1].(*stream).StreamID()
+		Expect(clientConn.(QUICConn).CloseStream(uint64(id))).To(Succeed())
+		Expect(clientConn.(QUICConn).StreamCount()).To(Equal(2))
+		_, err = strs[1].Write([]byte("foobar"))
+		Expect(err).To(HaveOccurred())
+		_, err = strs[2].Write([]byte("foobar"))
+		Expect(err).ToNot(HaveOccurred())
+		// the stream is gone, so closing it again fails
+		Expect(clientConn.(QUICConn).CloseStream(uint64(id))).ToNot(Succeed())
+		Expect(clientConn.(QUICConn).CloseStream(1337)).ToNot(Succeed())
+	})
+
+	It("forgets streams once both directions are finished", func() {
+		serverTransport, err := NewTransport(serverKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+		Expect(err).ToNot(HaveOccurred())
+		ln := runServer(serverTransport, "/ip4/127.0.0.1/udp/0/quic")
+		defer ln.Close()
+
+		clientTransport, err := NewTransport(clientKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+		Expect(err).ToNot(HaveOccurred())
+		clientConn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+		Expect(err).ToNot(HaveOccurred())
+		defer clientConn.Close()
+		serverConn, err := ln.Accept()
+		Expect(err).ToNot(HaveOccurred())
+		defer serverConn.Close()
+
+		hasStream := func(c tpt.CapableConn, str mux.MuxedStream) func() bool {
+			return func() bool {
+				c.(*conn).streamsMutex.Lock()
+				defer c.(*conn).streamsMutex.Unlock()
+				_, ok := c.(*conn).streams[str.(*stream).StreamID()]
+				return ok
+			}
+		}
+
+		// a stream closed by both sides
+		str, err := clientConn.OpenStream()
+		Expect(err).ToNot(HaveOccurred())
+		_, err = str.Write([]byte("foobar"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(str.Close()).To(Succeed())
+		sstr, err := serverConn.AcceptStream()
+		Expect(err).ToNot(HaveOccurred())
+		data, err := ioutil.ReadAll(sstr)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(data).To(Equal([]byte("foobar")))
+		// the server can still write to the stream
+		Consistently(hasStream(serverConn, sstr)).Should(BeTrue())
+		Expect(sstr.Close()).To(Succeed())
+		Eventually(hasStream(serverConn, sstr)).Should(BeFalse())
+		// the client only closed the write side so far
+		Expect(hasStream(clientConn, str)()).To(BeTrue())
+		_, err = ioutil.ReadAll(str)
+		Expect(err).ToNot(HaveOccurred())
+		Eventually(hasStream(clientConn, str)).Should(BeFalse())
+
+		// a stream reset by the peer
+		str, err = clientConn.OpenStream()
+		Expect(err).ToNot(HaveOccurred())
+		_, err = str.Write([]byte("foobar"))
+		Expect(err).ToNot(HaveOccurred())
+		sstr, err = serverConn.AcceptStream()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(str.Reset()).To(Succeed())
+		Expect(hasStream(clientConn, str)()).To(BeFalse())
+		_, err = ioutil.ReadAll(sstr)
+		Expect(err).To(HaveOccurred())
+		Eventually(hasStream(serverConn, sstr)).Should(BeFalse())
+	})
+
+	It("forgets streams written by WriteStream", func() {
+		const num = 10
+		serverTransport, err := NewTransport(serverKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+		Expect(err).ToNot(HaveOccurred())
+		ln := runServer(serverTransport, "/ip4/127.0.0.1/udp/0/quic")
+		defer ln.Close()
+
+		done := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			defer close(done)
+			conn, err := ln.Accept()
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+			for i := 0; i < num; i++ {
+				str, err := conn.AcceptStream()
+				Expect(err).ToNot(HaveOccurred())
+				data, err := ioutil.ReadAll(str)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(data).To(Equal([]byte("foobar")))
+			}
+		}()
+
+		clientTransport, err := NewTransport(clientKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+		Expect(err).ToNot(HaveOccurred())
+		clientConn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+		Expect(err).ToNot(HaveOccurred())
+		defer clientConn.Close()
+		for i := 0; i < num; i++ {
+			_, err := clientConn.(QUICConn).WriteStream(context.Background(), bytes.NewReader([]byte("foobar")))
+			Expect(err).ToNot(HaveOccurred())
+		}
+		Eventually(done).Should(BeClosed())
+		Eventually(func() int {
+			c := clientConn.(*conn)
+			c.streamsMutex.Lock()
+			defer c.streamsMutex.Unlock()
+			return len(c.streams)
+		}).Should(BeZero())
+	})
+
+	It("dials using a custom dialer", func() {
+		serverAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+		clientAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4321}
+		clientPipe, serverPipe := net.Pipe()
+		defer serverPipe.Close()
+
+		serverTransport, err := NewTransport(serverKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+		Expect(err).ToNot(HaveOccurred())
+		st := serverTransport.(*transport)
+		rconn := newReuseConn(&noreuseConn{Conn: &addrConn{Conn: serverPipe, laddr: serverAddr, raddr: clientAddr}})
+		rconn.IncreaseCount()
+		ln, err := newListener(rconn, st, st.localPeer, st.privKey, st.identity)
+		Expect(err).ToNot(HaveOccurred())
+		defer ln.Close()
+
+		dialed := make(chan string, 1)
+		dialer := func(_ context.Context, addr string) (net.Conn, error) {
+			dialed <- addr
+			return &addrConn{Conn: clientPipe, laddr: clientAddr, raddr: serverAddr}, nil
+		}
+		clientTransport, err := NewTransport(clientKey, WithGarbageCollectInterval(testGarbageCollectInterval), WithContextDialer(dialer))
+		Expect(err).ToNot(HaveOccurred())
+		serverMultiaddr, err := ma.NewMultiaddr("/ip4/127.0.0.1/udp/1234/quic")
+		Expect(err).ToNot(HaveOccurred())
+		clientMultiaddr, err := ma.NewMultiaddr("/ip4/127.0.0.1/udp/4321/quic")
+		Expect(err).ToNot(HaveOccurred())
+		clientConn, err := clientTransport.Dial(context.Background(), serverMultiaddr, serverID)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(dialed).To(Receive(Equal("127.0.0.1:1234")))
+		Expect(clientConn.LocalMultiaddr().Equal(clientMultiaddr)).To(BeTrue())
+		serverConn, err := ln.Accept()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(serverConn.RemotePeer()).To(Equal(clientID))
+		Expect(serverConn.RemoteMultiaddr().Equal(clientMultiaddr)).To(BeTrue())
+
+		str, err := clientConn.OpenStream()
+		Expect(err).ToNot(HaveOccurred())
+		_, err = str.Write([]byte("foobar"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(str.Close()).To(Succeed())
+		serverStr, err := serverConn.AcceptStream()
+		Expect(err).ToNot(HaveOccurred())
+		data, err := ioutil.ReadAll(serverStr)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(data).To(Equal([]byte("foobar")))
+
+		// the net.Conn returned by the dialer is closed once the connection is closed
+		Expect(clientConn.Close()).To(Succeed())
+		Eventually(func() error {
+			_, err := clientPipe.Write([]byte("foobar"))
+			return err
+		}).Should(MatchError(io.ErrClosedPipe))
+	})
+
+	Context("connection interceptors", func() {
+		type taggedConn struct {
+			tpt.CapableConn
+			tag string
+		}
+
+		It("wraps dialed and accepted connections, in order", func() {
+			var mutex sync.Mutex
+			var intercepted []string
+			interceptor := func(tag string) Option {
+				return WithConnectionInterceptor(func(c tpt.CapableConn) (tpt.CapableConn, error) {
+					mutex.Lock()
+					intercepted = append(intercepted, tag)
+					mutex.Unlock()
+					return &taggedConn{CapableConn: c, tag: tag}, nil
+				})
+			}
+
+			serverTransport, err := NewTransport(serverKey, WithGarbageCollectInterval(testGarbageCollectInterval), interceptor("server1"), interceptor("server2"))
+			Expect(err).ToNot(HaveOccurred())
+			ln := runServer(serverTransport, "/ip4/127.0.0.1/udp/0/quic")
+			defer ln.Close()
+			clientTransport, err := NewTransport(clientKey, WithGarbageCollectInterval(testGarbageCollectInterval), interceptor("client1"), interceptor("client2"))
+			Expect(err).ToNot(HaveOccurred())
+			clientConn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+			Expect(err).ToNot(HaveOccurred())
+			defer clientConn.Close()
+			serverConn, err := ln.Accept()
+			Expect(err).ToNot(HaveOccurred())
+			defer serverConn.Close()
+
+			mutex.Lock()
+			Expect(intercepted).To(ConsistOf("client1", "client2", "server1", "server2"))
+			mutex.Unlock()
+			Expect(clientConn).To(BeAssignableToTypeOf(&taggedConn{}))
+			Expect(clientConn.(*taggedConn).tag).To(Equal("client2"))
+			Expect(clientConn.(*taggedConn).CapableConn.(*taggedConn).tag).To(Equal("client1"))
+			Expect(serverConn.(*taggedConn).tag).To(Equal("server2"))
+			Expect(serverConn.(*taggedConn).CapableConn.(*taggedConn).tag).To(Equal("server1"))
+			Expect(serverConn.RemotePeer()).To(Equal(clientID))
+		})
+
+		It("closes connections if an interceptor fails", func() {
+			testErr := errors.New("test error")
+			serverTransport, err := NewTransport(serverKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+			Expect(err).ToNot(HaveOccurred())
+			ln := runServer(serverTransport, "/ip4/127.0.0.1/udp/0/quic")
+			defer ln.Close()
+			var interceptedConn tpt.CapableConn
+			clientTransport, err := NewTransport(
+				clientKey,
+				WithGarbageCollectInterval(testGarbageCollectInterval),
+				WithConnectionInterceptor(func(c tpt.CapableConn) (tpt.CapableConn, error) {
+					interceptedConn = c
+					return nil, testErr
+				}),
+			)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+			Expect(err).To(MatchError(testErr))
+			Expect(interceptedConn).ToNot(BeNil())
+			Eventually(interceptedConn.IsClosed).Should(BeTrue())
+			// The server only accepts the connection if its side of the handshake completed
+			// before the client closed the connection.
+			accepted := make(chan tpt.CapableConn, 1)
+			go func() {
+				if conn, err := ln.Accept(); err == nil {
+					accepted <- conn
+				}
+			}()
+			select {
+			case serverConn := <-accepted:
+				Eventually(serverConn.IsClosed).Should(BeTrue())
+			case <-time.After(500 * time.Millisecond):
+			}
+		})
+	})
+
+	It("drains connections to a peer", func() {
+		serverTransport, err := NewTransport(serverKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+		Expect(err).ToNot(HaveOccurred())
+		ln := runServer(serverTransport, "/ip4/127.0.0.1/udp/0/quic")
+		defer ln.Close()
+
+		clientTransport, err := NewTransport(clientKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+		Expect(err).ToNot(HaveOccurred())
+		clientConn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+		Expect(err).ToNot(HaveOccurred())
+		defer clientConn.Close()
+		serverConn, err := ln.Accept()
+		Expect(err).ToNot(HaveOccurred())
+		defer serverConn.Close()
+
+		str, err := clientConn.OpenStream()
+		Expect(err).ToNot(HaveOccurred())
+		_, err = str.Write([]byte("foobar"))
+		Expect(err).ToNot(HaveOccurred())
+		serverStr, err := serverConn.AcceptStream()
+		Expect(err).ToNot(HaveOccurred())
+
+		errChan := make(chan error, 1)
+		go func() {
+			errChan <- serverTransport.(*transport).DrainPeer(context.Background(), clientID)
+		}()
+		Consistently(errChan).ShouldNot(Receive())
+		// no new streams can be opened while draining
+		_, err = serverConn.(*conn).OpenStreamSync(context.Background())
+		Expect(err).To(MatchError(ErrConnDraining))
+		Expect(serverConn.IsClosed()).To(BeFalse())
+
+		Expect(serverStr.Close()).To(Succeed())
+		Eventually(errChan).Should(Receive(BeNil()))
+		Expect(serverConn.IsClosed()).To(BeTrue())
+		Eventually(clientConn.IsClosed).Should(BeTrue())
+	})
+
+	It("manages connections to peers through the QUICTransport interface", func() {
+		st, err := NewTransport(serverKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+		Expect(err).ToNot(HaveOccurred())
+		serverTransport := st.(QUICTransport)
+		ln := runServer(serverTransport, "/ip4/127.0.0.1/udp/0/quic")
+		defer ln.Close()
+		ct, err := NewTransport(clientKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+		Expect(err).ToNot(HaveOccurred())
+		clientTransport := ct.(QUICTransport)
+
+		// blacklisting
+		clientTransport.BlacklistPeer(serverID)
+		_, err = clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+		Expect(err).To(MatchError(ErrPeerBlacklisted))
+		clientTransport.UnblacklistPeer(serverID)
+
+		// closing
+		clientConn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+		Expect(err).ToNot(HaveOccurred())
+		serverConn, err := ln.Accept()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(serverTransport.ConnsToPeer(clientID)).To(ConsistOf(serverConn))
+		Expect(serverTransport.ClosePeer(clientID)).To(Succeed())
+		Expect(serverConn.IsClosed()).To(BeTrue())
+		Eventually(func() []tpt.CapableConn { return serverTransport.ConnsToPeer(clientID) }).Should(BeEmpty())
+		Eventually(clientConn.IsClosed).Should(BeTrue())
+
+		// draining
+		clientConn, err = clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+		Expect(err).ToNot(HaveOccurred())
+		serverConn, err = ln.Accept()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(serverTransport.DrainPeer(context.Background(), clientID)).To(Succeed())
+		Expect(serverConn.IsClosed()).To(BeTrue())
+		Eventually(clientConn.IsClosed).Should(BeTrue())
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		Expect(clientTransport.CloseContext(ctx)).To(Succeed())
+		Expect(serverTransport.Close()).To(Succeed())
+	})
+
+	It("closes connections when the context expires while draining", func() {
+		serverTransport, err := NewTransport(serverKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+		Expect(err).ToNot(HaveOccurred())
+		ln := runServer(serverTransport, "/ip4/127.0.0.1/udp/0/quic")
+		defer ln.Close()
+
+		clientTransport, err := NewTransport(clientKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+		Expect(err).ToNot(HaveOccurred())
+		conn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		serverConn, err := ln.Accept()
+		Expect(err).ToNot(HaveOccurred())
+		defer serverConn.Close()
+		_, err = serverConn.OpenStream()
+		Expect(err).ToNot(HaveOccurred())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		Expect(serverTransport.(*transport).DrainPeer(ctx, clientID)).To(MatchError(context.DeadlineExceeded))
+		Expect(serverConn.IsClosed()).To(BeTrue())
+	})
+
+	It("reports dialed and accepted connections to the stats collector", func() {
+		serverStats := &countingStatsCollector{}
+		serverTransport, err := NewTransport(serverKey, WithGarbageCollectInterval(testGarbageCollectInterval), WithStatsCollector(serverStats))
+		Expect(err).ToNot(HaveOccurred())
+		ln := runServer(serverTransport, "/ip4/127.0.0.1/udp/0/quic")
+		defer ln.Close()
+
+		clientStats := &countingStatsCollector{}
+		clientTransport, err := NewTransport(clientKey, WithGarbageCollectInterval(testGarbageCollectInterval), WithStatsCollector(clientStats))
+		Expect(err).ToNot(HaveOccurred())
+		conn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		serverConn, err := ln.Accept()
+		Expect(err).ToNot(HaveOccurred())
+		defer serverConn.Close()
+		// dial, but expect the wrong peer ID
+		thirdPartyID, _ := createPeer()
+		_, err = clientTransport.Dial(context.Background(), ln.Multiaddr(), thirdPartyID)
+		Expect(err).To(HaveOccurred())
+
+		Expect(atomic.LoadInt32(&clientStats.dialed)).To(BeEquivalentTo(1))
+		Expect(atomic.LoadInt32(&clientStats.dialErrors)).To(BeEquivalentTo(1))
+		Expect(atomic.LoadInt32(&clientStats.handshakes)).To(BeEquivalentTo(1))
+		Expect(atomic.LoadInt32(&clientStats.accepted)).To(BeZero())
+		Expect(atomic.LoadInt32(&serverStats.accepted)).To(BeEquivalentTo(1))
+		Expect(atomic.LoadInt32(&serverStats.dialed)).To(BeZero())
+	})
+
+	It("reports the number of open streams to the stats collector", func() {
+		serverStats := &countingStatsCollector{}
+		serverTransport, err := NewTransport(serverKey, WithGarbageCollectInterval(testGarbageCollectInterval), WithStatsCollector(serverStats))
+		Expect(err).ToNot(HaveOccurred())
+		ln := runServer(serverTransport, "/ip4/127.0.0.1/udp/0/quic")
+		defer ln.Close()
+
+		clientStats := &countingStatsCollector{}
+		clientTransport, err := NewTransport(clientKey, WithGarbageCollectInterval(testGarbageCollectInterval), WithStatsCollector(clientStats))
+		Expect(err).ToNot(HaveOccurred())
+		conn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		serverConn, err := ln.Accept()
+		Expect(err).ToNot(HaveOccurred())
+		defer serverConn.Close()
+
+		var strs []mux.MuxedStream
+		for i := 0; i < 3; i++ {
+			str, err := conn.OpenStream()
+			Expect(err).ToNot(HaveOccurred())
+			_, err = str.Write([]byte("foobar"))
+			Expect(err).ToNot(HaveOccurred())
+			strs = append(strs, str)
+		}
+		Expect(atomic.LoadInt32(&clientStats.streams)).To(BeEquivalentTo(3))
+		sstr, err := serverConn.AcceptStream()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(atomic.LoadInt32(&serverStats.streams)).To(BeEquivalentTo(1))
+
+		Expect(strs[0].Reset()).To(Succeed())
+		Expect(atomic.LoadInt32(&clientStats.streams)).To(BeEquivalentTo(2))
+		Expect(sstr.Reset()).To(Succeed())
+		Expect(atomic.LoadInt32(&serverStats.streams)).To(BeZero())
+	})
+
+	It("fails if the peer ID doesn't match", func() {
+		thirdPartyID, _ := createPeer()
+
+		serverTransport, err := NewTransport(serverKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+		Expect(err).ToNot(HaveOccurred())
+		ln := runServer(serverTransport, "/ip4/127.0.0.1/udp/0/quic")
+
+		clientTransport, err := NewTransport(clientKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+		Expect(err).ToNot(HaveOccurred())
+		// dial, but expect the wrong peer ID
+		_, err = clientTransport.Dial(context.Background(), ln.Multiaddr(), thirdPartyID)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("CRYPTO_ERROR"))
+
+		done := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			defer close(done)
+			ln.Accept()
+		}()
+		Consistently(done).ShouldNot(BeClosed())
+		ln.Close()
+		Eventually(done).Should(BeClosed())
+	})
+
+	It("fails if the peer ID verifier rejects the peer", func() {
+		serverTransport, err := NewTransport(serverKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+		Expect(err).ToNot(HaveOccurred())
+		ln := runServer(serverTransport, "/ip4/127.0.0.1/udp/0/quic")
+		defer ln.Close()
+
+		testErr := errors.New("peer rejected")
+		clientTransport, err := NewTransport(clientKey, WithGarbageCollectInterval(testGarbageCollectInterval), WithPeerIDVerifier(func(p peer.ID) error {
+			if p == serverID {
+				return testErr
+			}
+			return nil
+		}))
+		Expect(err).ToNot(HaveOccurred())
+		conn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+		Expect(err).To(MatchError(testErr))
+		Expect(conn).To(BeNil())
+	})
+
+	It("doesn't dial blacklisted peers", func() {
+		clientTransport, err := NewTransport(clientKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+		Expect(err).ToNot(HaveOccurred())
+		clientTransport.(*transport).BlacklistPeer(serverID)
+		addr, err := ma.NewMultiaddr("/ip4/127.0.0.1/udp/1234/quic")
+		Expect(err).ToNot(HaveOccurred())
+		_, err = clientTransport.Dial(context.Background(), addr, serverID)
+		Expect(err).To(MatchError(ErrPeerBlacklisted))
+	})
+
+	It("closes connections accepted from blacklisted peers", func() {
+		serverTransport, err := NewTransport(serverKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+		Expect(err).ToNot(HaveOccurred())
+		serverTransport.(*transport).BlacklistPeer(clientID)
+		ln := runServer(serverTransport, "/ip4/127.0.0.1/udp/0/quic")
+
+		done := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			defer close(done)
+			_, err := ln.Accept()
+			Expect(err).To(HaveOccurred())
+		}()
+
+		clientTransport, err := NewTransport(clientKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+		Expect(err).ToNot(HaveOccurred())
+		conn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = conn.AcceptStream()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring(ErrPeerBlacklisted.Error()))
+		Expect(conn.IsClosed()).To(BeTrue())
+
+		Consistently(done).ShouldNot(BeClosed())
+		ln.Close()
+		Eventually(done).Should(BeClosed())
+	})
+
+	It("only accepts connections from peers with a high enough score", func() {
+		_, otherClientKey := createPeer()
+		serverTransport, err := NewTransport(
+			serverKey,
+			WithGarbageCollectInterval(testGarbageCollectInterval),
+			WithPeerScorer(func(p peer.ID) float64 {
+				if p == clientID {
+					return 0.9
+				}
+				return 0.1
+			}),
+			WithAcceptScoreThreshold(0.5),
+		)
+		Expect(err).ToNot(HaveOccurred())
+		ln := runServer(serverTransport, "/ip4/127.0.0.1/udp/0/quic")
+		defer ln.Close()
+
+		acceptedConns := make(chan tpt.CapableConn, 2)
+		go func() {
+			defer GinkgoRecover()
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				acceptedConns <- conn
+			}
+		}()
+
+		// the low-score peer is rejected
+		otherClientTransport, err := NewTransport(otherClientKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+		Expect(err).ToNot(HaveOccurred())
+		rejectedConn, err := otherClientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = rejectedConn.AcceptStream()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("peer score too low"))
+
+		// the high-score peer is accepted
+		clientTransport, err := NewTransport(clientKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+		Expect(err).ToNot(HaveOccurred())
+		conn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		var serverConn tpt.CapableConn
+		Eventually(acceptedConns).Should(Receive(&serverConn))
+		defer serverConn.Close()
+		Expect(serverConn.RemotePeer()).To(Equal(clientID))
+		Consistently(acceptedConns).ShouldNot(Receive())
+	})
+
+	It("logs connection attempts", func() {
+		type logEntry struct {
+			peer peer.ID
+			addr net.Addr
+			dir  network.Direction
+			err  error
+		}
+		newLogger := func() (func(peer.ID, net.Addr, network.Direction, error), chan logEntry) {
+			entries := make(chan logEntry, 10)
+			return func(p peer.ID, addr net.Addr, dir network.Direction, err error) {
+				entries <- logEntry{peer: p, addr: addr, dir: dir, err: err}
+			}, entries
+		}
+		serverLogger, serverLog := newLogger()
+		serverTransport, err := NewTransport(serverKey, WithGarbageCollectInterval(testGarbageCollectInterval), WithConnectionLogger(serverLogger))
+		Expect(err).ToNot(HaveOccurred())
+		ln := runServer(serverTransport, "/ip4/127.0.0.1/udp/0/quic")
+		go func() {
+			for {
+				if _, err := ln.Accept(); err != nil {
+					return
+				}
+			}
+		}()
+		clientLogger, clientLog := newLogger()
+		clientTransport, err := NewTransport(clientKey, WithGarbageCollectInterval(testGarbageCollectInterval), WithConnectionLogger(clientLogger))
+		Expect(err).ToNot(HaveOccurred())
+		serverAddr := ln.Addr().(*net.UDPAddr)
+
+		// a successful connection
+		conn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		var entry logEntry
+		Expect(clientLog).To(Receive(&entry))
+		Expect(entry.peer).To(Equal(serverID))
+		Expect(entry.addr.(*net.UDPAddr).Port).To(Equal(serverAddr.Port))
+		Expect(entry.dir).To(Equal(network.DirOutbound))
+		Expect(entry.err).ToNot(HaveOccurred())
+		Eventually(serverLog).Should(Receive(&entry))
+		Expect(entry.peer).To(Equal(clientID))
+		clientPort, err := conn.LocalMultiaddr().ValueForProtocol(ma.P_UDP)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(strconv.Itoa(entry.addr.(*net.UDPAddr).Port)).To(Equal(clientPort))
+		Expect(entry.dir).To(Equal(network.DirInbound))
+		Expect(entry.err).ToNot(HaveOccurred())
+
+		// a connection rejected by the server
+		serverTransport.(*transport).BlacklistPeer(clientID)
+		conn2, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+		Expect(err).ToNot(HaveOccurred())
+		defer conn2.Close()
+		Expect(clientLog).To(Receive(&entry))
+		Expect(entry.err).ToNot(HaveOccurred())
+		Eventually(serverLog).Should(Receive(&entry))
+		Expect(entry.peer).To(Equal(clientID))
+		Expect(entry.dir).To(Equal(network.DirInbound))
+		Expect(entry.err).To(MatchError(ErrPeerBlacklisted))
+
+		// a failed dial
+		otherID, _ := createPeer()
+		_, err = clientTransport.Dial(context.Background(), ln.Multiaddr(), otherID)
+		Expect(err).To(HaveOccurred())
+		Expect(clientLog).To(Receive(&entry))
+		Expect(entry.peer).To(Equal(otherID))
+		Expect(entry.dir).To(Equal(network.DirOutbound))
+		Expect(entry.err).To(Equal(err))
+
+		Expect(ln.Close()).To(Succeed())
+		Consistently(clientLog).ShouldNot(Receive())
+	})
+
+	It("accepts connections from peers that were removed from the blacklist", func() {
+		serverTransport, err := NewTransport(serverKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+		Expect(err).ToNot(HaveOccurred())
+		serverTransport.(*transport).BlacklistPeer(clientID)
+		serverTransport.(*transport).UnblacklistPeer(clientID)
+		ln := runServer(serverTransport, "/ip4/127.0.0.1/udp/0/quic")
+		defer ln.Close()
+
+		clientTransport, err := NewTransport(clientKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+		Expect(err).ToNot(HaveOccurred())
+		conn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		serverConn, err := ln.Accept()
+		Expect(err).ToNot(HaveOccurred())
+		defer serverConn.Close()
+		Expect(serverConn.RemotePeer()).To(Equal(clientID))
+	})
+
+	It("transfers data when every other packet is dropped", func() {
+		var numPackets, numDropped int32
+		serverTransport, err := NewTransport(
+			serverKey,
+			WithGarbageCollectInterval(testGarbageCollectInterval),
+			WithPacketInterceptor(func(data []byte, _ net.Addr) []byte {
+				if atomic.AddInt32(&numPackets, 1)%2 == 0 {
+					atomic.AddInt32(&numDropped, 1)
+					return nil
+				}
+				return data
+			}),
+		)
+		Expect(err).ToNot(HaveOccurred())
+		ln := runServer(serverTransport, "/ip4/127.0.0.1/udp/0/quic")
+		defer ln.Close()
+
+		data := bytes.Repeat([]byte{'a'}, 50*1<<10) // 50 KB
+		done := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			defer close(done)
+			serverConn, err := ln.Accept()
+			Expect(err).ToNot(HaveOccurred())
+			defer serverConn.Close()
+			str, err := serverConn.AcceptStream()
+			Expect(err).ToNot(HaveOccurred())
+			b, err := ioutil.ReadAll(str)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(b).To(Equal(data))
+		}()
+
+		clientTransport, err := NewTransport(clientKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+		Expect(err).ToNot(HaveOccurred())
+		conn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		str, err := conn.OpenStream()
+		Expect(err).ToNot(HaveOccurred())
+		_, err = str.Write(data)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(str.Close()).To(Succeed())
+		Eventually(done, 10*time.Second).Should(BeClosed())
+		Expect(atomic.LoadInt32(&numDropped)).ToNot(BeZero())
+	})
+
+	It("resets connections using stateless resets after the server restarted", func() {
+		var resetKey [32]byte
+		rand.Read(resetKey[:])
+		serverTransport, err := NewTransport(
+			serverKey,
+			WithGarbageCollectInterval(testGarbageCollectInterval),
+			WithCustomStatelessResetKey(resetKey),
+		)
+		Expect(err).ToNot(HaveOccurred())
+		ln := runServer(serverTransport, "/ip4/127.0.0.1/udp/0/quic")
+
+		clientTransport, err := NewTransport(clientKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+		Expect(err).ToNot(HaveOccurred())
+		clientConn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+		Expect(err).ToNot(HaveOccurred())
+		defer clientConn.Close()
+		serverConn, err := ln.Accept()
+		Expect(err).ToNot(HaveOccurred())
+		str, err := clientConn.OpenStream()
+		Expect(err).ToNot(HaveOccurred())
+
+		// Simulate a crash: close the server's socket, so that no CONNECTION_CLOSE is sent.
+		Expect(ln.(*listener).conn.PacketConn.Close()).To(Succeed())
+		Eventually(serverConn.IsClosed).Should(BeTrue())
+		ln.Close()
+
+		// restart the server on the same port, using the same stateless reset key
+		restartedTransport, err := NewTransport(
+			serverKey,
+			WithGarbageCollectInterval(testGarbageCollectInterval),
+			WithCustomStatelessResetKey(resetKey),
+		)
+		Expect(err).ToNot(HaveOccurred())
+		restartedLn := runServer(restartedTransport, ln.Multiaddr().String())
+		defer restartedLn.Close()
+
+		_, err = str.Write(bytes.Repeat([]byte{'a'}, 1000))
+		Expect(err).ToNot(HaveOccurred())
+		Eventually(clientConn.(*conn).sess.Context().Done(), 5*time.Second).Should(BeClosed())
+		_, err = str.Write([]byte("foobar"))
+		Expect(err).To(MatchError(ContainSubstring("received a stateless reset")))
+	})
+
+	It("traces connections using the quic-trace tracer", func() {
+		tracer := quictrace.NewTracer()
+		serverTransport, err := NewTransport(serverKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+		Expect(err).ToNot(HaveOccurred())
+		ln := runServer(serverTransport, "/ip4/127.0.0.1/udp/0/quic")
+		defer ln.Close()
+
+		clientTransport, err := NewTransport(
+			clientKey,
+			WithGarbageCollectInterval(testGarbageCollectInterval),
+			WithQUICTracer(tracer),
+		)
+		Expect(err).ToNot(HaveOccurred())
+		conn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+		Expect(err).ToNot(HaveOccurred())
+		serverConn, err := ln.Accept()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(conn.Close()).To(Succeed())
+		Expect(serverConn.Close()).To(Succeed())
+		// The tracer processes events asynchronously, and GetAllTraces isn't safe for concurrent use.
+		// Give it some time to process the events of the closed connection.
+		time.Sleep(100 * time.Millisecond)
+
+		traces := tracer.GetAllTraces()
+		Expect(traces).To(HaveLen(1))
+		var eventTypes []pb.EventType
+		for _, data := range traces {
+			trace := &pb.Trace{}
+			Expect(proto.Unmarshal(data, trace)).To(Succeed())
+			for _, ev := range trace.GetEvents() {
+				eventTypes = append(eventTypes, ev.GetEventType())
+			}
+		}
+		Expect(eventTypes).To(ContainElement(pb.EventType_PACKET_SENT))
+		Expect(eventTypes).To(ContainElement(pb.EventType_PACKET_RECEIVED))
+	})
+
+	It("dials IPv4 and IPv6 addresses from the same dual-stack socket", func() {
+		serverTransport, err := NewTransport(serverKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+		Expect(err).ToNot(HaveOccurred())
+		ln4 := runServer(serverTransport, "/ip4/127.0.0.1/udp/0/quic")
+		defer ln4.Close()
+		ln6 := runServer(serverTransport, "/ip6/::1/udp/0/quic")
+		defer ln6.Close()
+		for _, ln := range []tpt.Listener{ln4, ln6} {
+			go func(ln tpt.Listener) {
+				for {
+					if _, err := ln.Accept(); err != nil {
+						return
+					}
+				}
+			}(ln)
+		}
+
+		clientTransport, err := NewTransport(clientKey, WithGarbageCollectInterval(testGarbageCollectInterval), WithDualStackReuse())
+		Expect(err).ToNot(HaveOccurred())
+		clientLn := runServer(clientTransport, "/ip6/::/udp/0/quic")
+		defer clientLn.Close()
+		port := clientLn.Addr().(*net.UDPAddr).Port
+
+		conn4, err := clientTransport.Dial(context.Background(), ln4.Multiaddr(), serverID)
+		Expect(err).ToNot(HaveOccurred())
+		defer conn4.Close()
+		conn6, err := clientTransport.Dial(context.Background(), ln6.Multiaddr(), serverID)
+		Expect(err).ToNot(HaveOccurred())
+		defer conn6.Close()
+		// the IPv4 connection uses the IPv4 unspecified address, although it was dialed from a dual-stack socket
+		Expect(conn4.LocalMultiaddr().String()).To(Equal(fmt.Sprintf("/ip4/0.0.0.0/udp/%d/quic", port)))
+		Expect(conn6.LocalMultiaddr().String()).To(Equal(fmt.Sprintf("/ip6/::/udp/%d/quic", port)))
+		udp4, udp6 := clientTransport.(*transport).connManager.NumConns()
+		Expect(udp4).To(BeZero())
+		Expect(udp6).To(Equal(1))
+	})
+
+	It("transfers data using multiple receive workers", func() {
+		serverTransport, err := NewTransport(serverKey, WithGarbageCollectInterval(testGarbageCollectInterval), WithReceiveWorkers(4))
+		Expect(err).ToNot(HaveOccurred())
+		ln := runServer(serverTransport, "/ip4/127.0.0.1/udp/0/quic")
+		defer ln.Close()
+
+		data := make([]byte, 1<<20) // 1 MB
+		rand.Read(data)
+		done := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			defer close(done)
+			serverConn, err := ln.Accept()
+			Expect(err).ToNot(HaveOccurred())
+			defer serverConn.Close()
+			str, err := serverConn.AcceptStream()
+			Expect(err).ToNot(HaveOccurred())
+			b, err := ioutil.ReadAll(str)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(bytes.Equal(b, data)).To(BeTrue())
+		}()
+
+		clientTransport, err := NewTransport(clientKey, WithGarbageCollectInterval(testGarbageCollectInterval), WithReceiveWorkers(4))
+		Expect(err).ToNot(HaveOccurred())
+		conn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		str, err := conn.OpenStream()
+		Expect(err).ToNot(HaveOccurred())
+		_, err = str.Write(data)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(str.Close()).To(Succeed())
+		Eventually(done, 10*time.Second).Should(BeClosed())
+	})
+
+	It("accepts connections using a worker pool", func() {
+		const num = 50
+		serverTransport, err := NewTransport(serverKey, WithGarbageCollectInterval(testGarbageCollectInterval), WithAcceptWorkerPool(8))
+		Expect(err).ToNot(HaveOccurred())
+		ln := runServer(serverTransport, "/ip4/127.0.0.1/udp/0/quic")
+
+		clientTransport, err := NewTransport(clientKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+		Expect(err).ToNot(HaveOccurred())
+		clientConns := make(chan tpt.CapableConn, num)
+		for i := 0; i < num; i++ {
+			go func() {
+				defer GinkgoRecover()
+				conn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+				Expect(err).ToNot(HaveOccurred())
+				clientConns <- conn
+			}()
+		}
+		for i := 0; i < num; i++ {
+			conn, err := ln.Accept()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conn.RemotePeer()).To(Equal(clientID))
+			defer conn.Close()
+		}
+		for i := 0; i < num; i++ {
+			var conn tpt.CapableConn
+			Eventually(clientConns).Should(Receive(&conn))
+			defer conn.Close()
+		}
+
+		Expect(ln.Close()).To(Succeed())
+		_, err = ln.Accept()
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("returns connections established by WarmUp", func() {
+		serverTransport, err := NewTransport(serverKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+		Expect(err).ToNot(HaveOccurred())
+		ln := runServer(serverTransport, "/ip4/127.0.0.1/udp/0/quic")
+		defer ln.Close()
+
+		clientStats := &countingStatsCollector{}
+		clientTransport, err := NewTransport(clientKey, WithGarbageCollectInterval(testGarbageCollectInterval), WithStatsCollector(clientStats))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(clientTransport.(QUICTransport).WarmUp(context.Background(), serverID, ln.Multiaddr())).To(Succeed())
+		Expect(clientTransport.(QUICTransport).WarmUp(context.Background(), serverID, ln.Multiaddr())).To(Succeed())
+		serverConn, err := ln.Accept()
+		Expect(err).ToNot(HaveOccurred())
+		defer serverConn.Close()
+
+		conn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		Expect(conn.IsClosed()).To(BeFalse())
+		Expect(atomic.LoadInt32(&clientStats.handshakes)).To(BeEquivalentTo(1))
+		// the warm connection is only returned once
+		Expect(clientTransport.(*transport).takeWarmConn(serverID, ln.Multiaddr())).To(BeNil())
+	})
+
+	It("doesn't return connections established by WarmUp to blacklisted peers", func() {
+		serverTransport, err := NewTransport(serverKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+		Expect(err).ToNot(HaveOccurred())
+		ln := runServer(serverTransport, "/ip4/127.0.0.1/udp/0/quic")
+		defer ln.Close()
+
+		clientTransport, err := NewTransport(clientKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(clientTransport.(QUICTransport).WarmUp(context.Background(), serverID, ln.Multiaddr())).To(Succeed())
+		serverConn, err := ln.Accept()
+		Expect(err).ToNot(HaveOccurred())
+		defer serverConn.Close()
+
+		clientTransport.(*transport).warmConnsMutex.Lock()
+		var warmConn *conn
+		for _, c := range clientTransport.(*transport).warmConns {
+			warmConn = c
+		}
+		clientTransport.(*transport).warmConnsMutex.Unlock()
+		Expect(warmConn).ToNot(BeNil())
+
+		clientTransport.(*transport).BlacklistPeer(serverID)
+		_, err = clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+		Expect(err).To(MatchError(ErrPeerBlacklisted))
+		Expect(warmConn.IsClosed()).To(BeTrue())
+		// the warm connection was discarded
+		clientTransport.(*transport).UnblacklistPeer(serverID)
+		Expect(clientTransport.(*transport).takeWarmConn(serverID, ln.Multiaddr())).To(BeNil())
+	})
+
+	It("dials asynchronously", func() {
+		const num = 5
+		serverTransport, err := NewTransport(serverKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+		Expect(err).ToNot(HaveOccurred())
+		ln := runServer(serverTransport, "/ip4/127.0.0.1/udp/0/quic")
+		defer ln.Close()
+		go func() {
+			defer GinkgoRecover()
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+			}
+		}()
+
+		clientTransport, err := NewTransport(clientKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+		Expect(err).ToNot(HaveOccurred())
+		var resChans []<-chan DialResult
+		for i := 0; i < num; i++ {
+			resChans = append(resChans, clientTransport.(QUICTransport).DialAsync(context.Background(), ln.Multiaddr(), serverID))
+		}
+		for _, resChan := range resChans {
+			var res DialResult
+			Eventually(resChan).Should(Receive(&res))
+			Expect(res.Err).ToNot(HaveOccurred())
+			Expect(res.Conn.RemotePeer()).To(Equal(serverID))
+			defer res.Conn.Close()
+		}
+	})
+
+	It("dials to two servers at the same time", func() {
+		serverID2, serverKey2 := createPeer()
+
+		serverTransport, err := NewTransport(serverKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+		Expect(err).ToNot(HaveOccurred())
+		ln1 := runServer(serverTransport, "/ip4/127.0.0.1/udp/0/quic")
+		serverTransport2, err := NewTransport(serverKey2, WithGarbageCollectInterval(testGarbageCollectInterval))
+		defer ln1.Close()
+		Expect(err).ToNot(HaveOccurred())
+		ln2 := runServer(serverTransport2, "/ip4/127.0.0.1/udp/0/quic")
+		defer ln2.Close()
+
+		data := bytes.Repeat([]byte{'a'}, 5*1<<20) // 5 MB
+		// wait for both servers to accept a connection
+		// then send some data
+		go func() {
+			serverConn1, err := ln1.Accept()
+			Expect(err).ToNot(HaveOccurred())
+			serverConn2, err := ln2.Accept()
+			Expect(err).ToNot(HaveOccurred())
+
+			for _, c := range []tpt.CapableConn{serverConn1, serverConn2} {
+				go func(conn tpt.CapableConn) {
+					defer GinkgoRecover()
+					str, err := conn.OpenStream()
+					Expect(err).ToNot(HaveOccurred())
+					defer str.Close()
+					_, err = str.Write(data)
+					Expect(err).ToNot(HaveOccurred())
+				}(c)
+			}
+		}()
+
+		clientTransport, err := NewTransport(clientKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+		Expect(err).ToNot(HaveOccurred())
+		c1, err := clientTransport.Dial(context.Background(), ln1.Multiaddr(), serverID)
+		Expect(err).ToNot(HaveOccurred())
+		defer c1.Close()
+		c2, err := clientTransport.Dial(context.Background(), ln2.Multiaddr(), serverID2)
+		Expect(err).ToNot(HaveOccurred())
+		defer c2.Close()
+
+		done := make(chan struct{}, 2)
+		// receive the data on both connections at the same time
+		for _, c := range []tpt.CapableConn{c1, c2} {
+			go func(conn tpt.CapableConn) {
+				defer GinkgoRecover()
+				str, err := conn.AcceptStream()
+				Expect(err).ToNot(HaveOccurred())
+				str.Close()
+				d, err := ioutil.ReadAll(str)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(d).To(Equal(data))
+				done <- struct{}{}
+			}(c)
+		}
+
+		Eventually(done, 5*time.Second).Should(Receive())
+		Eventually(done, 5*time.Second).Should(Receive())
+	})
+})
+
+// addrConn is a net.Conn that reports the given addresses, e.g. to make a net.Pipe look like a UDP socket.
+type addrConn struct {
+	net.Conn
+	laddr, raddr net.Addr
+}
+
+func (c *addrConn) LocalAddr() net.Addr  { return c.laddr }
+func (c *addrConn) RemoteAddr() net.Addr { return c.raddr }
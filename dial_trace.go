@@ -0,0 +1,34 @@
+package libp2pquic
+
+import (
+	"context"
+	"time"
+)
+
+// A DialTrace records when the phases of a dial completed.
+// Timestamps of phases that weren't reached are zero.
+type DialTrace struct {
+	// AddrResolved is the time the remote address was resolved.
+	AddrResolved time.Time
+	// SocketAcquired is the time a UDP socket was obtained for dialing.
+	SocketAcquired time.Time
+	// HandshakeStarted is the time the QUIC handshake was started.
+	HandshakeStarted time.Time
+	// HandshakeCompleted is the time the QUIC handshake, including the TLS key exchange, completed.
+	HandshakeCompleted time.Time
+	// ConnReady is the time the peer's identity was verified, and the connection was ready to be used.
+	ConnReady time.Time
+}
+
+type dialTraceKey struct{}
+
+// WithDialTrace returns a context that makes Dial record its progress in dt.
+func WithDialTrace(ctx context.Context, dt *DialTrace) context.Context {
+	return context.WithValue(ctx, dialTraceKey{}, dt)
+}
+
+// DialTraceFromContext returns the DialTrace set by WithDialTrace, or nil if there is none.
+func DialTraceFromContext(ctx context.Context) *DialTrace {
+	dt, _ := ctx.Value(dialTraceKey{}).(*DialTrace)
+	return dt
+}
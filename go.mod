@@ -1,6 +1,9 @@
 module github.com/libp2p/go-libp2p-quic-transport
 
+go 1.13
+
 require (
+	github.com/golang/protobuf v1.3.0
 	github.com/libp2p/go-libp2p-core v0.0.1
 	github.com/libp2p/go-libp2p-tls v0.1.1
 	github.com/lucas-clemente/quic-go v0.12.0
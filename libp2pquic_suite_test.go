@@ -22,7 +22,9 @@ var _ = BeforeSuite(func() {
 	mrand.Seed(GinkgoRandomSeed())
 })
 
-var garbageCollectIntervalOrig time.Duration
+// testGarbageCollectInterval is the garbage collection interval used by transports created in tests.
+const testGarbageCollectInterval = 50 * time.Millisecond
+
 var maxUnusedDurationOrig time.Duration
 
 func isGarbageCollectorRunning() bool {
@@ -33,14 +35,11 @@ func isGarbageCollectorRunning() bool {
 
 var _ = BeforeEach(func() {
 	Expect(isGarbageCollectorRunning()).To(BeFalse())
-	garbageCollectIntervalOrig = garbageCollectInterval
 	maxUnusedDurationOrig = maxUnusedDuration
-	garbageCollectInterval = 50 * time.Millisecond
 	maxUnusedDuration = 0
 })
 
 var _ = AfterEach(func() {
 	Eventually(isGarbageCollectorRunning).Should(BeFalse())
-	garbageCollectInterval = garbageCollectIntervalOrig
 	maxUnusedDuration = maxUnusedDurationOrig
 })
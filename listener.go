@@ -3,7 +3,11 @@ package libp2pquic
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	ic "github.com/libp2p/go-libp2p-core/crypto"
 	"github.com/libp2p/go-libp2p-core/peer"
@@ -14,17 +18,56 @@ import (
 	ma "github.com/multiformats/go-multiaddr"
 )
 
+// ErrDeadlineExceeded is returned by Accept if the deadline set by SetDeadline passed.
+// It implements net.Error, and its Timeout method returns true.
+var ErrDeadlineExceeded error = deadlineExceededError{}
+
+type deadlineExceededError struct{}
+
+func (deadlineExceededError) Error() string   { return "deadline exceeded" }
+func (deadlineExceededError) Timeout() bool   { return true }
+func (deadlineExceededError) Temporary() bool { return true }
+
+// errPeerScoreTooLow is the reason connections from peers rejected by the peer scorer are closed with.
+var errPeerScoreTooLow = errors.New("peer score too low")
+
+// A QUICListener is a tpt.Listener for QUIC connections.
+type QUICListener interface {
+	tpt.Listener
+	// BoundMultiaddr returns the multiaddr the listener is bound to.
+	// If the listener was started on port 0, it contains the port chosen by the operating system.
+	BoundMultiaddr() ma.Multiaddr
+	// SetDeadline sets the deadline for Accept calls.
+	// Once it passed, Accept returns ErrDeadlineExceeded.
+	// It also applies to Accept calls that are already blocked. A zero value disables the deadline.
+	SetDeadline(t time.Time) error
+}
+
 // A listener listens for QUIC connections.
 type listener struct {
+	closed int32 // set to 1 when Close is called, accessed atomically
+
 	quicListener   quic.Listener
 	conn           *reuseConn
 	transport      *transport
 	privKey        ic.PrivKey
 	localPeer      peer.ID
 	localMultiaddr ma.Multiaddr
+
+	deadlineMutex   sync.Mutex
+	deadline        time.Time
+	deadlineChanged chan struct{} // closed when the deadline is changed
+
+	// Only used if the transport was configured with WithAcceptWorkerPool.
+	// The workers send accepted connections on accepted, which is closed once they have exited.
+	// acceptErr is the error that stopped the accept loop, and must only be read after accepted was closed.
+	accepted  chan *conn
+	acceptErr error
+	closeChan chan struct{}
+	closeOnce sync.Once
 }
 
-var _ tpt.Listener = &listener{}
+var _ QUICListener = &listener{}
 
 func newListener(rconn *reuseConn, t *transport, localPeer peer.ID, key ic.PrivKey, identity *p2ptls.Identity) (tpt.Listener, error) {
 	var tlsConf tls.Config
@@ -36,7 +79,7 @@ func newListener(rconn *reuseConn, t *transport, localPeer peer.ID, key ic.PrivK
 		conf, _ := identity.ConfigForAny()
 		return conf, nil
 	}
-	ln, err := quic.Listen(rconn, &tlsConf, quicConfig)
+	ln, err := quic.Listen(rconn, &tlsConf, t.quicConfig)
 	if err != nil {
 		return nil, err
 	}
@@ -44,33 +87,185 @@ func newListener(rconn *reuseConn, t *transport, localPeer peer.ID, key ic.PrivK
 	if err != nil {
 		return nil, err
 	}
-	return &listener{
+	l := &listener{
 		conn:           rconn,
 		quicListener:   ln,
 		transport:      t,
 		privKey:        key,
 		localPeer:      localPeer,
 		localMultiaddr: localMultiaddr,
-	}, nil
+		closeChan:      make(chan struct{}),
+	}
+	l.deadlineChanged = make(chan struct{})
+	if t.acceptWorkers > 0 {
+		l.startAcceptWorkers(t.acceptWorkers)
+	}
+	return l, nil
+}
+
+// startAcceptWorkers starts a goroutine that accepts QUIC sessions,
+// and n workers that set up connections for these sessions.
+func (l *listener) startAcceptWorkers(n int) {
+	l.accepted = make(chan *conn)
+	sessions := make(chan quic.Session, n)
+	go func() {
+		defer close(sessions)
+		for {
+			sess, err := l.quicListener.Accept(context.Background())
+			if err != nil {
+				l.handleAcceptError(err)
+				l.acceptErr = err
+				return
+			}
+			sessions <- sess
+		}
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			for sess := range sessions {
+				conn, ok := l.handleSession(sess)
+				if !ok {
+					continue
+				}
+				select {
+				case l.accepted <- conn:
+				case <-l.closeChan:
+					conn.Close()
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(l.accepted)
+	}()
 }
 
 // Accept accepts new connections.
+// If the deadline set by SetDeadline passes while Accept is blocked, it returns ErrDeadlineExceeded.
 func (l *listener) Accept() (tpt.CapableConn, error) {
 	for {
-		sess, err := l.quicListener.Accept(context.Background())
+		ctx, cancel := l.deadlineContext()
+		conn, err := l.accept(ctx)
+		ctxErr := ctx.Err()
+		cancel()
+		if err == nil {
+			return conn, nil
+		}
+		switch ctxErr {
+		case context.DeadlineExceeded:
+			return nil, ErrDeadlineExceeded
+		case context.Canceled:
+			// the deadline was changed, try again with the new deadline
+			continue
+		}
+		return nil, err
+	}
+}
+
+// deadlineContext returns a context that is done once the deadline passed, or once the deadline is changed.
+func (l *listener) deadlineContext() (context.Context, context.CancelFunc) {
+	l.deadlineMutex.Lock()
+	deadline, changed := l.deadline, l.deadlineChanged
+	l.deadlineMutex.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if !deadline.IsZero() {
+		var cancelDeadline context.CancelFunc
+		ctx, cancelDeadline = context.WithDeadline(ctx, deadline)
+		cancelAll := cancel
+		cancel = func() {
+			cancelDeadline()
+			cancelAll()
+		}
+	}
+	go func() {
+		select {
+		case <-changed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+func (l *listener) accept(ctx context.Context) (tpt.CapableConn, error) {
+	if l.accepted != nil {
+		for {
+			select {
+			case conn, ok := <-l.accepted:
+				if !ok {
+					return nil, l.acceptErr
+				}
+				if c, err := l.transport.interceptConn(conn); err == nil {
+					return c, nil
+				}
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+	}
+
+	for {
+		sess, err := l.quicListener.Accept(ctx)
 		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			l.handleAcceptError(err)
 			return nil, err
 		}
-		conn, err := l.setupConn(sess)
-		if err != nil {
-			sess.CloseWithError(0, err.Error())
+		conn, ok := l.handleSession(sess)
+		if !ok {
 			continue
 		}
-		return conn, nil
+		if c, err := l.transport.interceptConn(conn); err == nil {
+			return c, nil
+		}
+	}
+}
+
+// handleAcceptError reports errors that stop the listener from accepting connections.
+func (l *listener) handleAcceptError(err error) {
+	if atomic.LoadInt32(&l.closed) == 0 && l.transport.listenerErrorHandler != nil {
+		l.transport.listenerErrorHandler(err)
 	}
 }
 
-func (l *listener) setupConn(sess quic.Session) (tpt.CapableConn, error) {
+// handleSession sets up the connection for an accepted QUIC session.
+// It returns false if the connection was rejected. In that case, the session is closed.
+func (l *listener) handleSession(sess quic.Session) (*conn, bool) {
+	conn, err := l.setupConn(sess)
+	if err != nil {
+		l.transport.logAccept("", sess.RemoteAddr(), err)
+		sess.CloseWithError(0, err.Error())
+		return nil, false
+	}
+	if l.transport.isBlacklisted(conn.remotePeerID) {
+		l.transport.logAccept(conn.remotePeerID, sess.RemoteAddr(), ErrPeerBlacklisted)
+		sess.CloseWithError(errorCodeConnectionGating, ErrPeerBlacklisted.Error())
+		return nil, false
+	}
+	if scorer := l.transport.peerScorer; scorer != nil && scorer(conn.remotePeerID) < l.transport.acceptScoreThreshold {
+		l.transport.logAccept(conn.remotePeerID, sess.RemoteAddr(), errPeerScoreTooLow)
+		sess.CloseWithError(errorCodeConnectionGating, errPeerScoreTooLow.Error())
+		return nil, false
+	}
+	if !l.transport.addConn(conn) {
+		l.transport.logAccept(conn.remotePeerID, sess.RemoteAddr(), ErrTransportClosed)
+		sess.CloseWithError(0, ErrTransportClosed.Error())
+		return nil, false
+	}
+	l.transport.logAccept(conn.remotePeerID, sess.RemoteAddr(), nil)
+	l.transport.stats.IncrAccepted()
+	return conn, true
+}
+
+func (l *listener) setupConn(sess quic.Session) (*conn, error) {
 	// The tls.Config used to establish this connection already verified the certificate chain.
 	// Since we don't have any way of knowing which tls.Config was used though,
 	// we have to re-determine the peer's identity here.
@@ -88,24 +283,42 @@ func (l *listener) setupConn(sess quic.Session) (tpt.CapableConn, error) {
 		return nil, err
 	}
 	return &conn{
-		sess:            sess,
-		transport:       l.transport,
-		localPeer:       l.localPeer,
-		localMultiaddr:  l.localMultiaddr,
-		privKey:         l.privKey,
-		remoteMultiaddr: remoteMultiaddr,
-		remotePeerID:    remotePeerID,
-		remotePubKey:    remotePubKey,
+		id:                newConnID(),
+		sess:              sess,
+		transport:         l.transport,
+		streamObserver:    l.transport.streamObserver,
+		streamErrorMapper: l.transport.streamErrorMapper,
+		countStreams:      l.transport.countStreams,
+		localPeer:         l.localPeer,
+		localMultiaddr:    l.localMultiaddr,
+		privKey:           l.privKey,
+		remoteMultiaddr:   remoteMultiaddr,
+		remotePeerID:      remotePeerID,
+		remotePubKey:      remotePubKey,
 	}, nil
 }
 
+// SetDeadline sets the deadline for Accept calls.
+func (l *listener) SetDeadline(t time.Time) error {
+	l.deadlineMutex.Lock()
+	l.deadline = t
+	// wake up blocked Accept calls, so they pick up the new deadline
+	close(l.deadlineChanged)
+	l.deadlineChanged = make(chan struct{})
+	l.deadlineMutex.Unlock()
+	return nil
+}
+
 // Close closes the listener.
 func (l *listener) Close() error {
-	defer l.conn.DecreaseCount()
+	atomic.StoreInt32(&l.closed, 1)
+	l.closeOnce.Do(func() { close(l.closeChan) })
+	defer l.conn.StopListening()
 	return l.quicListener.Close()
 }
 
 // Addr returns the address of this listener.
+// It is the *net.UDPAddr of the UDP socket the listener is using.
 func (l *listener) Addr() net.Addr {
 	return l.quicListener.Addr()
 }
@@ -114,3 +327,8 @@ func (l *listener) Addr() net.Addr {
 func (l *listener) Multiaddr() ma.Multiaddr {
 	return l.localMultiaddr
 }
+
+// BoundMultiaddr returns the multiaddress this listener is bound to.
+func (l *listener) BoundMultiaddr() ma.Multiaddr {
+	return l.localMultiaddr
+}
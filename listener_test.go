@@ -1,13 +1,18 @@
 package libp2pquic
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"fmt"
 	"net"
+	"sync"
+	"testing"
+	"time"
 
 	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
 	tpt "github.com/libp2p/go-libp2p-core/transport"
 
 	ma "github.com/multiformats/go-multiaddr"
@@ -23,7 +28,7 @@ var _ = Describe("Listener", func() {
 		Expect(err).ToNot(HaveOccurred())
 		key, err := ic.UnmarshalRsaPrivateKey(x509.MarshalPKCS1PrivateKey(rsaKey))
 		Expect(err).ToNot(HaveOccurred())
-		t, err = NewTransport(key)
+		t, err = NewTransport(key, WithGarbageCollectInterval(testGarbageCollectInterval))
 		Expect(err).ToNot(HaveOccurred())
 	})
 
@@ -68,6 +73,20 @@ var _ = Describe("Listener", func() {
 		})
 	})
 
+	It("returns the bound multiaddr", func() {
+		localAddr, err := ma.NewMultiaddr("/ip4/127.0.0.1/udp/0/quic")
+		Expect(err).ToNot(HaveOccurred())
+		ln, err := t.Listen(localAddr)
+		Expect(err).ToNot(HaveOccurred())
+		defer ln.Close()
+		Expect(ln).To(BeAssignableToTypeOf(&listener{}))
+		boundAddr := ln.(QUICListener).BoundMultiaddr()
+		port, err := boundAddr.ValueForProtocol(ma.P_UDP)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(port).ToNot(Equal("0"))
+		Expect(boundAddr.String()).To(Equal(fmt.Sprintf("/ip4/127.0.0.1/udp/%d/quic", ln.Addr().(*net.UDPAddr).Port)))
+	})
+
 	Context("accepting connections", func() {
 		var localAddr ma.Multiaddr
 
@@ -100,5 +119,167 @@ var _ = Describe("Listener", func() {
 			_, err = ln.Accept()
 			Expect(err).To(HaveOccurred())
 		})
+
+		It("returns ErrDeadlineExceeded once the deadline passed", func() {
+			ln, err := t.Listen(localAddr)
+			Expect(err).ToNot(HaveOccurred())
+			defer ln.Close()
+			Expect(ln.(QUICListener).SetDeadline(time.Now().Add(100 * time.Millisecond))).To(Succeed())
+			start := time.Now()
+			_, err = ln.Accept()
+			Expect(err).To(MatchError(ErrDeadlineExceeded))
+			Expect(err.(net.Error).Timeout()).To(BeTrue())
+			Expect(time.Since(start)).To(And(
+				BeNumerically(">=", 100*time.Millisecond),
+				BeNumerically("<", 200*time.Millisecond),
+			))
+			// deadlines in the past make Accept return immediately
+			_, err = ln.Accept()
+			Expect(err).To(MatchError(ErrDeadlineExceeded))
+		})
+
+		It("wakes up a blocked Accept when the deadline is set", func() {
+			ln, err := t.Listen(localAddr)
+			Expect(err).ToNot(HaveOccurred())
+			defer ln.Close()
+			errChan := make(chan error, 1)
+			go func() {
+				defer GinkgoRecover()
+				_, err := ln.Accept()
+				errChan <- err
+			}()
+			Consistently(errChan).ShouldNot(Receive())
+			// extending the deadline keeps Accept blocked
+			Expect(ln.(QUICListener).SetDeadline(time.Now().Add(time.Hour))).To(Succeed())
+			Consistently(errChan).ShouldNot(Receive())
+			Expect(ln.(QUICListener).SetDeadline(time.Now().Add(50 * time.Millisecond))).To(Succeed())
+			Eventually(errChan).Should(Receive(MatchError(ErrDeadlineExceeded)))
+		})
+
+		Context("reporting errors", func() {
+			var errChan chan error
+
+			BeforeEach(func() {
+				errChan = make(chan error, 10)
+				rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+				Expect(err).ToNot(HaveOccurred())
+				key, err := ic.UnmarshalRsaPrivateKey(x509.MarshalPKCS1PrivateKey(rsaKey))
+				Expect(err).ToNot(HaveOccurred())
+				t, err = NewTransport(
+					key,
+					WithGarbageCollectInterval(testGarbageCollectInterval),
+					WithListenerErrorHandler(func(err error) { errChan <- err }),
+				)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("reports errors when the underlying socket is closed", func() {
+				ln, err := t.Listen(localAddr)
+				Expect(err).ToNot(HaveOccurred())
+				defer ln.Close()
+				acceptErr := make(chan error, 1)
+				go func() {
+					defer GinkgoRecover()
+					_, err := ln.Accept()
+					acceptErr <- err
+				}()
+				Consistently(acceptErr).ShouldNot(Receive())
+				Expect(ln.(*listener).conn.PacketConn.Close()).To(Succeed())
+				var err1, err2 error
+				Eventually(acceptErr).Should(Receive(&err1))
+				Expect(err1).To(HaveOccurred())
+				Eventually(errChan).Should(Receive(&err2))
+				Expect(err2).To(Equal(err1))
+			})
+
+			It("doesn't report errors when the listener is closed", func() {
+				ln, err := t.Listen(localAddr)
+				Expect(err).ToNot(HaveOccurred())
+				done := make(chan struct{})
+				go func() {
+					defer GinkgoRecover()
+					defer close(done)
+					_, err := ln.Accept()
+					Expect(err).To(HaveOccurred())
+				}()
+				Consistently(done).ShouldNot(BeClosed())
+				Expect(ln.Close()).To(Succeed())
+				Eventually(done).Should(BeClosed())
+				Expect(errChan).ToNot(Receive())
+			})
+		})
 	})
 })
+
+func benchmarkAccept(b *testing.B, workers int) {
+	const num = 50
+	serverKey, _, err := ic.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		b.Fatal(err)
+	}
+	serverID, err := peer.IDFromPrivateKey(serverKey)
+	if err != nil {
+		b.Fatal(err)
+	}
+	clientKey, _, err := ic.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		b.Fatal(err)
+	}
+	var opts []Option
+	if workers > 0 {
+		opts = append(opts, WithAcceptWorkerPool(workers))
+	}
+	serverTransport, err := NewTransport(serverKey, opts...)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer serverTransport.(*transport).Close()
+	clientTransport, err := NewTransport(clientKey)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer clientTransport.(*transport).Close()
+	addr, err := ma.NewMultiaddr("/ip4/127.0.0.1/udp/0/quic")
+	if err != nil {
+		b.Fatal(err)
+	}
+	ln, err := serverTransport.Listen(addr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ln.Close()
+
+	defer b.StopTimer()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var wg sync.WaitGroup
+		wg.Add(num)
+		for j := 0; j < num; j++ {
+			go func() {
+				defer wg.Done()
+				conn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				conn.Close()
+			}()
+		}
+		for j := 0; j < num; j++ {
+			conn, err := ln.Accept()
+			if err != nil {
+				b.Fatal(err)
+			}
+			conn.Close()
+		}
+		wg.Wait()
+	}
+}
+
+func BenchmarkAccept_WorkerPool(b *testing.B) {
+	for _, workers := range []int{1, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			benchmarkAccept(b, workers)
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package libp2pquic
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	mrand "math/rand"
+	"net"
+	"sync"
+	"time"
+
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type conditionedPacket struct {
+	data []byte
+	addr net.Addr
+}
+
+// A networkConditioner wraps a net.PacketConn, and simulates bad network conditions for received packets.
+// Packets are delayed by a normally distributed latency, and randomly dropped, duplicated or reordered.
+type networkConditioner struct {
+	net.PacketConn
+
+	latency, latencyStdDev               time.Duration
+	lossRate, duplicateRate, reorderRate float64
+
+	rand *mrand.Rand // only used by the read loop
+
+	packets   chan conditionedPacket
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newNetworkConditioner(conn net.PacketConn, latency, latencyStdDev time.Duration, lossRate, duplicateRate, reorderRate float64) *networkConditioner {
+	c := &networkConditioner{
+		PacketConn:    conn,
+		latency:       latency,
+		latencyStdDev: latencyStdDev,
+		lossRate:      lossRate,
+		duplicateRate: duplicateRate,
+		reorderRate:   reorderRate,
+		rand:          mrand.New(mrand.NewSource(GinkgoRandomSeed())),
+		packets:       make(chan conditionedPacket, 1000),
+		closed:        make(chan struct{}),
+	}
+	go c.readLoop()
+	return c
+}
+
+func (c *networkConditioner) readLoop() {
+	for {
+		b := make([]byte, 2000)
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		if err != nil {
+			c.Close()
+			return
+		}
+		if c.rand.Float64() < c.lossRate {
+			continue
+		}
+		p := conditionedPacket{data: b[:n], addr: addr}
+		c.schedule(p, c.delay())
+		if c.rand.Float64() < c.duplicateRate {
+			c.schedule(p, c.delay())
+		}
+	}
+}
+
+func (c *networkConditioner) delay() time.Duration {
+	d := c.latency + time.Duration(c.rand.NormFloat64()*float64(c.latencyStdDev))
+	if c.rand.Float64() < c.reorderRate {
+		// delay the packet long enough for the following packets to overtake it
+		d += 2 * c.latency
+	}
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
+
+func (c *networkConditioner) schedule(p conditionedPacket, delay time.Duration) {
+	time.AfterFunc(delay, func() {
+		select {
+		case c.packets <- p:
+		case <-c.closed:
+		default: // the queue is full, drop the packet
+		}
+	})
+}
+
+func (c *networkConditioner) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case p := <-c.packets:
+		return copy(b, p.data), p.addr, nil
+	case <-c.closed:
+		return 0, nil, errors.New("use of closed network conditioner")
+	}
+}
+
+func (c *networkConditioner) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		err = c.PacketConn.Close()
+	})
+	return err
+}
+
+var _ = Describe("Network Conditions", func() {
+	It("transfers data on a lossy network", func() {
+		serverKey, _, err := ic.GenerateEd25519Key(rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		serverID, err := peer.IDFromPrivateKey(serverKey)
+		Expect(err).ToNot(HaveOccurred())
+		clientKey, _, err := ic.GenerateEd25519Key(rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+
+		serverTransport, err := NewTransport(serverKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+		Expect(err).ToNot(HaveOccurred())
+		addr, err := ma.NewMultiaddr("/ip4/127.0.0.1/udp/0/quic")
+		Expect(err).ToNot(HaveOccurred())
+		ln, err := serverTransport.Listen(addr)
+		Expect(err).ToNot(HaveOccurred())
+		defer ln.Close()
+
+		data := make([]byte, 200*1<<10) // 200 KB
+		rand.Read(data)
+		go func() {
+			defer GinkgoRecover()
+			conn, err := ln.Accept()
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+			str, err := conn.AcceptStream()
+			Expect(err).ToNot(HaveOccurred())
+			_, err = str.Write(data)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(str.Close()).To(Succeed())
+			// wait until the client closes the connection
+			conn.AcceptStream()
+		}()
+
+		// Make the client transport dial from a socket with bad network conditions.
+		clientTransport, err := NewTransport(clientKey, WithGarbageCollectInterval(testGarbageCollectInterval))
+		Expect(err).ToNot(HaveOccurred())
+		udpConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		Expect(err).ToNot(HaveOccurred())
+		conditioner := newNetworkConditioner(udpConn, 5*time.Millisecond, 2*time.Millisecond, 0.05, 0.01, 0.05)
+		reuse := clientTransport.(*transport).connManager.reuseUDP4
+		port := udpConn.LocalAddr().(*net.UDPAddr).Port
+		reuse.mutex.Lock()
+		reuse.global[port] = newReuseConn(conditioner)
+		reuse.mutex.Unlock()
+
+		conn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		str, err := conn.OpenStream()
+		Expect(err).ToNot(HaveOccurred())
+		// the server only accepts the stream once we send some data
+		_, err = str.Write([]byte("ping"))
+		Expect(err).ToNot(HaveOccurred())
+		received, err := ioutil.ReadAll(str)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(received).To(Equal(data))
+	})
+})
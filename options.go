@@ -0,0 +1,470 @@
+package libp2pquic
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	tpt "github.com/libp2p/go-libp2p-core/transport"
+
+	quic "github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/quictrace"
+)
+
+// An Option configures the QUIC transport.
+type Option func(*config) error
+
+type config struct {
+	// quicConfig is a copy of the default QUIC config, which options may modify.
+	quicConfig *quic.Config
+
+	peerIDVerifier   func(peer.ID) error
+	handshakeTimeout time.Duration
+	connectTimeout   time.Duration
+	retryAttempts    int
+	retryBackoff     time.Duration
+	retryMaxBackoff  time.Duration
+	readBufferSize   int
+	writeBufferSize  int
+
+	garbageCollectInterval time.Duration
+	streamObserver         StreamObserver
+	streamErrorMapper      func(error) error
+	statsCollector         StatsCollector
+	listenerErrorHandler   func(error)
+	packetInterceptor      func([]byte, net.Addr) []byte
+	addrBook               peerstore.AddrBook
+	peerScorer             func(peer.ID) float64
+	acceptScoreThreshold   float64
+	acceptWorkers          int
+	listenPortFallback     bool
+	gcUtilizationFactor    float64
+	collectStaleSockets    bool
+	quicConfigMutators     []func(*quic.Config)
+	ipFreeBind             bool
+	maxPendingDialsPerPeer int
+	receiveWorkers         int
+	connLogger             func(peer.ID, net.Addr, network.Direction, error)
+	keyExchangeTimeout     time.Duration
+	dualStackReuse         bool
+	contextDialer          func(ctx context.Context, addr string) (net.Conn, error)
+	connInterceptors       []func(tpt.CapableConn) (tpt.CapableConn, error)
+}
+
+func (cfg *config) apply(opts ...Option) error {
+	for _, opt := range opts {
+		if err := opt(cfg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validate checks invariants that involve multiple options, or that options don't check themselves.
+func (cfg *config) validate() error {
+	if cfg.handshakeTimeout < 0 {
+		return errors.New("handshake timeout must not be negative")
+	}
+	if cfg.quicConfig.MaxReceiveConnectionFlowControlWindow < cfg.quicConfig.MaxReceiveStreamFlowControlWindow {
+		return errors.New("the connection receive window must not be smaller than the stream receive window")
+	}
+	return nil
+}
+
+// WithPeerIDVerifier sets a function that is called when dialing a peer,
+// after the TLS handshake verified the peer's identity.
+// If it returns an error, the QUIC session is closed and Dial returns the error.
+func WithPeerIDVerifier(fn func(peer.ID) error) Option {
+	return func(cfg *config) error {
+		cfg.peerIDVerifier = fn
+		return nil
+	}
+}
+
+// WithHandshakeTimeout sets a timeout for the QUIC handshake when dialing.
+// It only applies if the context passed to Dial doesn't have a deadline.
+// A value of 0 disables the timeout.
+func WithHandshakeTimeout(d time.Duration) Option {
+	return func(cfg *config) error {
+		cfg.handshakeTimeout = d
+		return nil
+	}
+}
+
+// WithConnectTimeout sets a timeout for the whole dial, including the QUIC and TLS handshake.
+// Unlike the handshake timeout, it also applies if the context passed to Dial has a deadline.
+// In that case, whichever expires first ends the dial.
+func WithConnectTimeout(d time.Duration) Option {
+	return func(cfg *config) error {
+		if d <= 0 {
+			return errors.New("connect timeout must be positive")
+		}
+		cfg.connectTimeout = d
+		return nil
+	}
+}
+
+// WithMaxPendingDialsPerPeer limits the number of dials to a single peer that can be in progress at the same time.
+// Once the limit is reached, Dial returns ErrTooManyPendingDials for that peer, without dialing.
+func WithMaxPendingDialsPerPeer(n int) Option {
+	return func(cfg *config) error {
+		if n < 1 {
+			return errors.New("maximum number of pending dials per peer must be at least 1")
+		}
+		cfg.maxPendingDialsPerPeer = n
+		return nil
+	}
+}
+
+// WithKeyExchangeTimeout makes Dial wait up to d for the peer's public key after the QUIC handshake completed.
+// By default, Dial expects the key to be available right away, and fails otherwise.
+// If the timeout expires, the session is closed, and Dial returns ErrKeyExchangeTimeout.
+func WithKeyExchangeTimeout(d time.Duration) Option {
+	return func(cfg *config) error {
+		if d <= 0 {
+			return errors.New("key exchange timeout must be positive")
+		}
+		cfg.keyExchangeTimeout = d
+		return nil
+	}
+}
+
+// WithRetryBudget makes Dial retry dials that failed temporarily, e.g. because the handshake timed out.
+// Dial makes at most attempts attempts. Between attempts, it waits for a jittered backoff,
+// starting at initialBackoff and doubling after every attempt, up to maxBackoff.
+// Retries stop as soon as the context passed to Dial is canceled, or its deadline expires.
+func WithRetryBudget(attempts int, initialBackoff, maxBackoff time.Duration) Option {
+	return func(cfg *config) error {
+		if attempts < 1 {
+			return errors.New("number of dial attempts must be at least 1")
+		}
+		if initialBackoff <= 0 {
+			return errors.New("initial retry backoff must be positive")
+		}
+		if maxBackoff < initialBackoff {
+			return errors.New("maximum retry backoff must not be smaller than the initial backoff")
+		}
+		cfg.retryAttempts = attempts
+		cfg.retryBackoff = initialBackoff
+		cfg.retryMaxBackoff = maxBackoff
+		return nil
+	}
+}
+
+// WithUDPBufferSize sets the sizes of the receive and transmit buffers of the UDP sockets
+// created by the transport. A size of 0 keeps the operating system's default.
+func WithUDPBufferSize(readBytes, writeBytes int) Option {
+	return func(cfg *config) error {
+		if readBytes < 0 || writeBytes < 0 {
+			return errors.New("UDP buffer sizes must not be negative")
+		}
+		cfg.readBufferSize = readBytes
+		cfg.writeBufferSize = writeBytes
+		return nil
+	}
+}
+
+// WithGarbageCollectInterval sets the interval at which the transport closes
+// UDP sockets that are not used any more.
+func WithGarbageCollectInterval(d time.Duration) Option {
+	return func(cfg *config) error {
+		if d <= 0 {
+			return errors.New("garbage collection interval must be positive")
+		}
+		cfg.garbageCollectInterval = d
+		return nil
+	}
+}
+
+// WithUnidirectionalStreams allows the peer to open up to maxIn unidirectional streams.
+// By default, unidirectional streams are disabled.
+func WithUnidirectionalStreams(maxIn int) Option {
+	return func(cfg *config) error {
+		if maxIn < 1 {
+			return errors.New("the number of unidirectional streams must be positive")
+		}
+		cfg.quicConfig.MaxIncomingUniStreams = maxIn
+		return nil
+	}
+}
+
+// WithStreamLimits sets the number of bidirectional and unidirectional streams the peer is allowed to open.
+// A value of 0 selects quic-go's default. uni may be set to -1 to disable unidirectional streams.
+func WithStreamLimits(bidi, uni int) Option {
+	return func(cfg *config) error {
+		if bidi < 0 {
+			return errors.New("the number of bidirectional streams must not be negative")
+		}
+		if uni < -1 {
+			return errors.New("the number of unidirectional streams must be at least -1")
+		}
+		cfg.quicConfig.MaxIncomingStreams = bidi
+		cfg.quicConfig.MaxIncomingUniStreams = uni
+		return nil
+	}
+}
+
+// WithDisableKeepAlive disables QUIC keep-alive packets.
+// Connections without activity are then closed once quic-go's idle timeout expires.
+func WithDisableKeepAlive() Option {
+	return func(cfg *config) error {
+		cfg.quicConfig.KeepAlive = false
+		return nil
+	}
+}
+
+// WithMaxStreamReceiveWindow sets the maximum flow control window for receiving data on a stream.
+// It must not be larger than the connection receive window.
+func WithMaxStreamReceiveWindow(bytes uint64) Option {
+	return func(cfg *config) error {
+		if bytes == 0 {
+			return errors.New("the stream receive window must be positive")
+		}
+		cfg.quicConfig.MaxReceiveStreamFlowControlWindow = bytes
+		return nil
+	}
+}
+
+// WithMaxConnectionReceiveWindow sets the maximum flow control window for receiving data on a connection.
+// It must not be smaller than the stream receive window.
+func WithMaxConnectionReceiveWindow(bytes uint64) Option {
+	return func(cfg *config) error {
+		if bytes == 0 {
+			return errors.New("the connection receive window must be positive")
+		}
+		cfg.quicConfig.MaxReceiveConnectionFlowControlWindow = bytes
+		return nil
+	}
+}
+
+// WithCustomStatelessResetKey sets the key used to generate stateless reset tokens.
+// The key is used as is, which is useful if it is managed externally,
+// for example when the host's private key is kept in an HSM.
+// To reset connections established before a restart, the same key must be used after the restart.
+// By default, no key is set, and sending of stateless resets is disabled.
+func WithCustomStatelessResetKey(key [32]byte) Option {
+	return func(cfg *config) error {
+		cfg.quicConfig.StatelessResetKey = key[:]
+		return nil
+	}
+}
+
+// WithQUICTracer sets the quic-trace tracer that all connections of this transport are traced with.
+// The tracer returned by quictrace.NewTracer buffers all events until GetAllTraces is called,
+// so it should only be used for debugging.
+func WithQUICTracer(t quictrace.Tracer) Option {
+	return func(cfg *config) error {
+		cfg.quicConfig.QuicTracer = t
+		return nil
+	}
+}
+
+// WithStreamObserver sets a StreamObserver that is notified about every stream
+// opened and accepted on connections of this transport.
+func WithStreamObserver(o StreamObserver) Option {
+	return func(cfg *config) error {
+		cfg.streamObserver = o
+		return nil
+	}
+}
+
+// WithStreamErrorMapper sets a function that translates errors returned when reading from
+// or writing to a stream, for example to map QUIC error codes (see quic.StreamError)
+// to application-specific errors. io.EOF is not passed to the function.
+func WithStreamErrorMapper(fn func(error) error) Option {
+	return func(cfg *config) error {
+		cfg.streamErrorMapper = fn
+		return nil
+	}
+}
+
+// WithStatsCollector sets a StatsCollector that is notified about dialed and accepted connections.
+func WithStatsCollector(c StatsCollector) Option {
+	return func(cfg *config) error {
+		cfg.statsCollector = c
+		return nil
+	}
+}
+
+// WithListenerErrorHandler sets a function that is called when a listener stops accepting
+// connections because of an error, for example because the underlying UDP socket was closed.
+// It is not called when the listener is closed using Close.
+func WithListenerErrorHandler(fn func(error)) Option {
+	return func(cfg *config) error {
+		cfg.listenerErrorHandler = fn
+		return nil
+	}
+}
+
+// WithConnectionLogger sets a function that is called for every connection attempt, e.g. to keep an audit log.
+// It is called synchronously when a dial completes, with network.DirOutbound, and when the listener
+// accepted or rejected a connection, with network.DirInbound. err is nil if the connection was established.
+// The peer ID is empty if the connection failed before the peer was authenticated.
+// The address is nil if the dialed multiaddr doesn't contain an IP address.
+func WithConnectionLogger(fn func(p peer.ID, addr net.Addr, dir network.Direction, err error)) Option {
+	return func(cfg *config) error {
+		cfg.connLogger = fn
+		return nil
+	}
+}
+
+// WithContextDialer sets a function that creates the socket used for dialing, instead of the transport's UDP sockets.
+// This is useful if packets need to be sent through a proxy, e.g. a sidecar in a containerized environment.
+// fn is called for every dial, with the UDP address (host:port) of the peer, and the returned net.Conn is used
+// for that connection only. Every Read must return a single packet, and every Write must send one.
+// The net.Conn is closed once the connection is closed.
+// The transport's sockets aren't used for dialing, so dials don't use the port set by WithSourcePort,
+// and the packet interceptor set by WithPacketInterceptor isn't called for packets received on it.
+func WithContextDialer(fn func(ctx context.Context, addr string) (net.Conn, error)) Option {
+	return func(cfg *config) error {
+		cfg.contextDialer = fn
+		return nil
+	}
+}
+
+// WithConnectionInterceptor adds a function that wraps every connection before it is returned
+// by Dial or Accept, e.g. to add rate limiting or logging.
+// Multiple interceptors are called in the order they were passed, each one receiving
+// the connection returned by the previous one.
+// If an interceptor returns an error, the connection is closed. Dial then returns that error,
+// and Accept continues with the next connection.
+// The connections returned by ConnsToPeer are not wrapped.
+func WithConnectionInterceptor(fn func(tpt.CapableConn) (tpt.CapableConn, error)) Option {
+	return func(cfg *config) error {
+		cfg.connInterceptors = append(cfg.connInterceptors, fn)
+		return nil
+	}
+}
+
+// WithPacketInterceptor sets a function that is called for every UDP packet received
+// by the transport, before it is processed by QUIC. It is intended for testing and debugging.
+// The returned slice is processed instead of the packet. If it returns nil, the packet is dropped.
+func WithPacketInterceptor(fn func(data []byte, from net.Addr) []byte) Option {
+	return func(cfg *config) error {
+		cfg.packetInterceptor = fn
+		return nil
+	}
+}
+
+// WithAddrBook sets an address book that is used to look up the peer's addresses
+// when Dial is called with a multiaddr that only contains a peer ID (/ipfs/<peer ID>).
+// The first address that the transport can dial is used.
+func WithAddrBook(ab peerstore.AddrBook) Option {
+	return func(cfg *config) error {
+		cfg.addrBook = ab
+		return nil
+	}
+}
+
+// WithPeerScorer sets a function that scores peers when accepting connections.
+// Connections from peers with a score below the threshold set by WithAcceptScoreThreshold are closed.
+func WithPeerScorer(fn func(peer.ID) float64) Option {
+	return func(cfg *config) error {
+		cfg.peerScorer = fn
+		return nil
+	}
+}
+
+// WithAcceptScoreThreshold sets the minimum score a peer needs for its connection to be accepted.
+// It only has an effect if a scorer was set using WithPeerScorer. It defaults to 0.
+func WithAcceptScoreThreshold(f float64) Option {
+	return func(cfg *config) error {
+		cfg.acceptScoreThreshold = f
+		return nil
+	}
+}
+
+// WithAcceptWorkerPool makes listeners set up accepted connections on n goroutines in parallel.
+// By default, connections are set up one after another, when Accept is called.
+func WithAcceptWorkerPool(n int) Option {
+	return func(cfg *config) error {
+		if n < 1 {
+			return errors.New("the accept worker pool must have at least one worker")
+		}
+		cfg.acceptWorkers = n
+		return nil
+	}
+}
+
+// WithListenPortFallback makes Listen try the next 10 ports if the requested port is already in use.
+// The multiaddr of the returned listener contains the port that was actually used.
+func WithListenPortFallback() Option {
+	return func(cfg *config) error {
+		cfg.listenPortFallback = true
+		return nil
+	}
+}
+
+// WithGarbageCollectUtilizationFactor keeps UDP sockets that carried a lot of traffic around for longer
+// before garbage collecting them.
+// Once a socket is not used any more, it is kept for its lifetime multiplied by factor,
+// scaled down if its average throughput was below 1 MB/s, but at least for the default duration.
+func WithGarbageCollectUtilizationFactor(factor float64) Option {
+	return func(cfg *config) error {
+		if factor < 0 {
+			return errors.New("garbage collection utilization factor must not be negative")
+		}
+		cfg.gcUtilizationFactor = factor
+		return nil
+	}
+}
+
+// WithStaleSocketCollection makes the transport garbage collect UDP sockets that weren't written to
+// for a while, even if they're still referenced, as long as they're neither used by a listener nor by a live connection.
+// This cleans up sockets whose references weren't released after all their connections were closed.
+func WithStaleSocketCollection() Option {
+	return func(cfg *config) error {
+		cfg.collectStaleSockets = true
+		return nil
+	}
+}
+
+// WithReceiveWorkers makes the transport read packets from each UDP socket on n goroutines,
+// instead of only on the goroutine quic-go uses to process received packets.
+// This allows reading from the socket in parallel, at the cost of slightly reordering packets.
+func WithReceiveWorkers(n int) Option {
+	return func(cfg *config) error {
+		if n < 1 {
+			return errors.New("number of receive workers must be at least 1")
+		}
+		cfg.receiveWorkers = n
+		return nil
+	}
+}
+
+// WithDualStackReuse makes the transport use dual-stack IPv6 sockets, which handle both IPv4 and IPv6 traffic,
+// whenever it binds a socket to the unspecified IPv6 address.
+// IPv4 addresses are then dialed from these sockets as well, e.g. from the socket of a listener on /ip6/::,
+// instead of from separate IPv4 sockets. IPv4 sockets are still used for listening on IPv4 addresses.
+func WithDualStackReuse() Option {
+	return func(cfg *config) error {
+		cfg.dualStackReuse = true
+		return nil
+	}
+}
+
+// WithIPFreeBind makes Listen set the IP_FREEBIND socket option,
+// so that the transport can listen on an IP address that is not assigned to an interface yet.
+// This is only supported on Linux. On other systems, it is a no-op.
+func WithIPFreeBind() Option {
+	return func(cfg *config) error {
+		cfg.ipFreeBind = true
+		return nil
+	}
+}
+
+// WithQUICConfigMutator allows modifying the quic.Config used for dialing and listening,
+// for settings that are not covered by the other options.
+// The mutator is called at the end of NewTransport, after all other options were applied.
+// Multiple mutators are called in the order they were passed.
+// The resulting config is not validated, so use with care.
+func WithQUICConfigMutator(fn func(*quic.Config)) Option {
+	return func(cfg *config) error {
+		cfg.quicConfigMutators = append(cfg.quicConfigMutators, fn)
+		return nil
+	}
+}
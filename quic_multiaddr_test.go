@@ -27,4 +27,16 @@ var _ = Describe("QUIC Multiaddr", func() {
 		Expect(udpAddr.IP).To(Equal(net.IPv4(192, 168, 0, 42)))
 		Expect(udpAddr.Port).To(Equal(1337))
 	})
+
+	It("converts a scoped IPv6 QUIC Multiaddr to a net.Addr", func() {
+		maddr, err := ma.NewMultiaddr("/ip6zone/eth0/ip6/fe80::1/udp/1337/quic")
+		Expect(err).ToNot(HaveOccurred())
+		addr, err := fromQuicMultiaddr(maddr)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(addr).To(BeAssignableToTypeOf(&net.UDPAddr{}))
+		udpAddr := addr.(*net.UDPAddr)
+		Expect(udpAddr.IP).To(Equal(net.ParseIP("fe80::1")))
+		Expect(udpAddr.Zone).To(Equal("eth0"))
+		Expect(udpAddr.Port).To(Equal(1337))
+	})
 })
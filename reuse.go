@@ -1,29 +1,85 @@
 package libp2pquic
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net"
+	"os"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/vishvananda/netlink"
 )
 
 // Constants. Defined as variables to simplify testing.
-var (
-	garbageCollectInterval = 30 * time.Second
-	maxUnusedDuration      = 10 * time.Second
+var maxUnusedDuration = 10 * time.Second
+
+// errReuseClosed is returned when using a reuse after it was closed.
+// net.ErrClosed can't be used, since it was only added in Go 1.16.
+var errReuseClosed = errors.New("reuse closed")
+
+const (
+	// defaultGarbageCollectInterval is the interval at which a reuse garbage collects
+	// unused connections by default.
+	defaultGarbageCollectInterval = 30 * time.Second
+	// highUtilizationThroughput is the average throughput (in bytes per second) at which
+	// a connection counts as fully utilized by the garbage collector.
+	highUtilizationThroughput = 1 << 20
 )
 
 type reuseConn struct {
+	// must be the first fields, so they're 64 bit aligned on 32 bit platforms
+	totalBytesWritten uint64 // accessed atomically
+	lastWritten       int64  // Unix time in nanoseconds, accessed atomically
+
 	net.PacketConn
 
+	createdAt time.Time
+
 	mutex       sync.Mutex
 	refCount    int
 	unusedSince time.Time
+	// listening is set while a listener uses the connection
+	listening bool
+	// sessions contains the contexts of the sessions dialed from this connection
+	// that haven't released their reference yet
+	sessions []context.Context
 }
 
 func newReuseConn(conn net.PacketConn) *reuseConn {
-	return &reuseConn{PacketConn: conn}
+	now := time.Now()
+	return &reuseConn{PacketConn: conn, createdAt: now, lastWritten: now.UnixNano()}
+}
+
+// WriteTo writes a packet, counts the bytes written, and records the time of the write.
+func (c *reuseConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	n, err := c.PacketConn.WriteTo(p, addr)
+	atomic.AddUint64(&c.totalBytesWritten, uint64(n))
+	atomic.StoreInt64(&c.lastWritten, time.Now().UnixNano())
+	return n, err
+}
+
+// SetReadBuffer sets the size of the operating system's receive buffer of the underlying socket.
+func (c *reuseConn) SetReadBuffer(bytes int) error {
+	conn, ok := c.PacketConn.(interface{ SetReadBuffer(int) error })
+	if !ok {
+		return errors.New("connection doesn't support setting the receive buffer size")
+	}
+	return conn.SetReadBuffer(bytes)
+}
+
+// SetWriteBuffer sets the size of the operating system's transmit buffer of the underlying socket.
+func (c *reuseConn) SetWriteBuffer(bytes int) error {
+	conn, ok := c.PacketConn.(interface{ SetWriteBuffer(int) error })
+	if !ok {
+		return errors.New("connection doesn't support setting the transmit buffer size")
+	}
+	return conn.SetWriteBuffer(bytes)
 }
 
 func (c *reuseConn) IncreaseCount() {
@@ -39,28 +95,277 @@ func (c *reuseConn) DecreaseCount() {
 	if c.refCount == 0 {
 		c.unusedSince = time.Now()
 	}
+	c.removeClosedSessionsLocked()
+	c.mutex.Unlock()
+}
+
+// AddSession tracks a session dialed from this connection.
+// The session is considered alive until ctx is done.
+func (c *reuseConn) AddSession(ctx context.Context) {
+	c.mutex.Lock()
+	c.sessions = append(c.sessions, ctx)
 	c.mutex.Unlock()
 }
 
-func (c *reuseConn) ShouldGarbageCollect(now time.Time) bool {
+// StopListening is called when the listener using the connection is closed.
+// It releases the listener's reference.
+func (c *reuseConn) StopListening() {
+	c.mutex.Lock()
+	c.listening = false
+	c.mutex.Unlock()
+	c.DecreaseCount()
+}
+
+// must be called while holding the mutex
+func (c *reuseConn) removeClosedSessionsLocked() {
+	sessions := c.sessions[:0]
+	for _, ctx := range c.sessions {
+		if ctx.Err() == nil {
+			sessions = append(sessions, ctx)
+		}
+	}
+	for i := len(sessions); i < len(c.sessions); i++ {
+		c.sessions[i] = nil
+	}
+	c.sessions = sessions
+}
+
+// isStaleLocked says if none of the references to the connection are held by a listener,
+// a live session, or a dial that's still in progress.
+// must be called while holding the mutex
+func (c *reuseConn) isStaleLocked() bool {
+	if c.listening {
+		return false
+	}
+	// References that aren't held by a tracked session belong to a dial that's still in progress.
+	if c.refCount > len(c.sessions) {
+		return false
+	}
+	for _, ctx := range c.sessions {
+		if ctx.Err() == nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *reuseConn) usage() (refCount int, unusedSince time.Time) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
-	return !c.unusedSince.IsZero() && c.unusedSince.Add(maxUnusedDuration).Before(now)
+	return c.refCount, c.unusedSince
+}
+
+// ShouldGarbageCollect says if the connection has been unused for longer than its grace period.
+// The grace period is maxUnusedDuration, or its lifetime multiplied by cfg.gcUtilizationFactor and its utilization,
+// whichever is longer. This keeps connections that carried a lot of traffic around for longer.
+// If cfg.collectStaleConns is set, connections that are still referenced, but neither used by a listener
+// nor by a live session, and weren't written to for longer than maxUnusedDuration are garbage collected as well.
+func (c *reuseConn) ShouldGarbageCollect(now time.Time, cfg *reuseConfig) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.unusedSince.IsZero() {
+		return cfg.collectStaleConns && c.isStaleLocked() && c.lastWrittenTime().Add(maxUnusedDuration).Before(now)
+	}
+	gracePeriod := maxUnusedDuration
+	if cfg.gcUtilizationFactor > 0 {
+		lifetime := c.unusedSince.Sub(c.createdAt)
+		if d := time.Duration(float64(lifetime) * cfg.gcUtilizationFactor * c.utilization(lifetime)); d > gracePeriod {
+			gracePeriod = d
+		}
+	}
+	return c.unusedSince.Add(gracePeriod).Before(now)
+}
+
+func (c *reuseConn) lastWrittenTime() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.lastWritten))
+}
+
+// utilization returns the average throughput over the lifetime of the connection,
+// relative to highUtilizationThroughput. The value is capped at 1.
+func (c *reuseConn) utilization(lifetime time.Duration) float64 {
+	if lifetime <= 0 {
+		return 0
+	}
+	throughput := float64(atomic.LoadUint64(&c.totalBytesWritten)) / lifetime.Seconds()
+	if throughput >= highUtilizationThroughput {
+		return 1
+	}
+	return throughput / highUtilizationThroughput
+}
+
+// isHealthy checks if the underlying socket is still usable.
+// The socket might have been closed externally.
+// Rather than writing to the socket, this checks that the file descriptor is still open.
+func (c *reuseConn) isHealthy() bool {
+	sc, ok := c.PacketConn.(syscall.Conn)
+	if !ok {
+		return true
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return false
+	}
+	return rc.Control(func(uintptr) {}) == nil
+}
+
+// An interceptingConn passes every received packet to intercept before returning it.
+// It embeds the *net.UDPConn, so that socket options can still be set, and the health check still works.
+type interceptingConn struct {
+	*net.UDPConn
+	intercept func([]byte, net.Addr) []byte
+}
+
+// ReadFrom reads the next packet that isn't dropped by the interceptor.
+func (c *interceptingConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.UDPConn.ReadFrom(p)
+		if err != nil {
+			return n, addr, err
+		}
+		data := c.intercept(p[:n], addr)
+		if data == nil {
+			continue
+		}
+		return copy(p, data), addr, nil
+	}
+}
+
+// receiveBufferSize is the size of the buffers the receive workers read packets into.
+// It is the largest possible UDP payload, so that packets are never truncated before
+// they're copied into the buffer passed to ReadFrom.
+const receiveBufferSize = 1<<16 - 1 - 8 // 16 bit length field minus the UDP header
+
+var receiveBufferPool = sync.Pool{
+	New: func() interface{} { return make([]byte, receiveBufferSize) },
+}
+
+type receivedPacket struct {
+	data []byte // a buffer from the receiveBufferPool
+	n    int
+	addr net.Addr
+}
+
+// A receiveWorkersConn reads packets from the underlying socket on multiple goroutines.
+// ReadFrom returns the packets in the order they were read by the workers, which might differ
+// slightly from the order they were received in.
+// It embeds the *net.UDPConn, so that socket options can still be set, and the health check still works.
+type receiveWorkersConn struct {
+	*net.UDPConn
+
+	packets chan receivedPacket
+
+	closeOnce sync.Once
+	closed    chan struct{} // closed when Close is called
+
+	errOnce sync.Once
+	err     error         // the error that stopped the first worker, only read after done is closed
+	done    chan struct{} // closed once all workers have exited
+}
+
+// newReceiveWorkersConn starts n goroutines calling read, which reads a packet from conn.
+func newReceiveWorkersConn(conn *net.UDPConn, read func([]byte) (int, net.Addr, error), n int) *receiveWorkersConn {
+	c := &receiveWorkersConn{
+		UDPConn: conn,
+		packets: make(chan receivedPacket, 4*n),
+		closed:  make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			c.runWorker(read)
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(c.done)
+	}()
+	return c
+}
+
+func (c *receiveWorkersConn) runWorker(read func([]byte) (int, net.Addr, error)) {
+	for {
+		data := receiveBufferPool.Get().([]byte)
+		n, addr, err := read(data)
+		if err != nil {
+			receiveBufferPool.Put(data)
+			c.errOnce.Do(func() { c.err = err })
+			return
+		}
+		select {
+		case c.packets <- receivedPacket{data: data, n: n, addr: addr}:
+		case <-c.closed:
+			receiveBufferPool.Put(data)
+			return
+		}
+	}
+}
+
+func (c *receiveWorkersConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case packet := <-c.packets:
+		n := copy(p, packet.data[:packet.n])
+		receiveBufferPool.Put(packet.data)
+		return n, packet.addr, nil
+	case <-c.done:
+		return 0, nil, c.err
+	}
+}
+
+// Close closes the underlying socket, which stops the workers.
+func (c *receiveWorkersConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.UDPConn.Close()
+}
+
+type reuseConfig struct {
+	// garbageCollectInterval is the interval at which unused connections are garbage collected.
+	// Defaults to defaultGarbageCollectInterval.
+	garbageCollectInterval time.Duration
+	// readBufferSize and writeBufferSize set the socket buffer sizes of newly created connections.
+	// If 0, the operating system's default is used.
+	readBufferSize, writeBufferSize int
+	// packetInterceptor, if set, is called for every packet received on newly created connections.
+	packetInterceptor func([]byte, net.Addr) []byte
+	// listenPortFallback makes Listen try the following ports if the requested port is already in use.
+	listenPortFallback bool
+	// gcUtilizationFactor extends the grace period of connections that carried a lot of traffic.
+	// See reuseConn.ShouldGarbageCollect. If 0, all connections are collected after maxUnusedDuration.
+	gcUtilizationFactor float64
+	// collectStaleConns makes the garbage collector close connections that are still referenced,
+	// but neither used by a listener nor by a live session, and weren't written to for longer than maxUnusedDuration.
+	collectStaleConns bool
+	// ipFreeBind makes Listen set IP_FREEBIND on new sockets. Only supported on Linux.
+	ipFreeBind bool
+	// dualStack makes the reuse create dual-stack sockets when binding to the unspecified address,
+	// which can be used for both IPv4 and IPv6 traffic.
+	dualStack bool
+	// receiveWorkers is the number of goroutines reading packets from newly created connections.
+	// If smaller than 2, packets are read on the goroutine calling ReadFrom.
+	receiveWorkers int
 }
 
 type reuse struct {
+	cfg reuseConfig
+
 	mutex sync.Mutex
 
 	garbageCollectorRunning bool
 
 	handle *netlink.Handle // Only set on Linux. nil on other systems.
 
+	closeOnce sync.Once
+	closeChan chan struct{} // closed when Close is called
+	closed    bool          // set when Close is called, protected by the mutex
+
 	unicast map[string] /* IP.String() */ map[int] /* port */ *reuseConn
 	// global contains connections that are listening on 0.0.0.0 / ::
 	global map[int]*reuseConn
 }
 
-func newReuse() (*reuse, error) {
+func newReuse(cfg reuseConfig) (*reuse, error) {
 	// On non-Linux systems, this will return ErrNotImplemented.
 	handle, err := netlink.NewHandle()
 	if err == netlink.ErrNotImplemented {
@@ -68,29 +373,99 @@ func newReuse() (*reuse, error) {
 	} else if err != nil {
 		return nil, err
 	}
+	if cfg.garbageCollectInterval <= 0 {
+		cfg.garbageCollectInterval = defaultGarbageCollectInterval
+	}
 	return &reuse{
-		unicast: make(map[string]map[int]*reuseConn),
-		global:  make(map[int]*reuseConn),
-		handle:  handle,
+		cfg:       cfg,
+		unicast:   make(map[string]map[int]*reuseConn),
+		global:    make(map[int]*reuseConn),
+		handle:    handle,
+		closeChan: make(chan struct{}),
 	}, nil
 }
 
+// newConn wraps a newly created socket, and applies the configured socket options.
+func (r *reuse) newConn(conn *net.UDPConn) (*reuseConn, error) {
+	if r.cfg.readBufferSize > 0 {
+		if err := conn.SetReadBuffer(r.cfg.readBufferSize); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if r.cfg.writeBufferSize > 0 {
+		if err := conn.SetWriteBuffer(r.cfg.writeBufferSize); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	var pconn net.PacketConn = conn
+	if r.cfg.packetInterceptor != nil {
+		pconn = &interceptingConn{UDPConn: conn, intercept: r.cfg.packetInterceptor}
+	}
+	if r.cfg.receiveWorkers > 1 {
+		pconn = newReceiveWorkersConn(conn, pconn.ReadFrom, r.cfg.receiveWorkers)
+	}
+	return newReuseConn(pconn), nil
+}
+
+// findMostUsedLocked returns the healthy connection with the highest reference count.
+// The connection that's used most is the least likely to be garbage collected soon.
+// Connections whose socket was closed are removed from conns.
+// must be called while holding the mutex
+func findMostUsedLocked(conns map[int]*reuseConn) *reuseConn {
+	var best *reuseConn
+	bestCount := -1
+	for port, c := range conns {
+		if !c.isHealthy() {
+			delete(conns, port)
+			continue
+		}
+		if count, _ := c.usage(); count > bestCount {
+			best = c
+			bestCount = count
+		}
+	}
+	return best
+}
+
+// NumConns returns the number of connections tracked, both global and unicast.
+func (r *reuse) NumConns() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	num := len(r.global)
+	for _, conns := range r.unicast {
+		num += len(conns)
+	}
+	return num
+}
+
 func (r *reuse) runGarbageCollector() {
-	ticker := time.NewTicker(garbageCollectInterval)
+	ticker := time.NewTicker(r.cfg.garbageCollectInterval)
 	defer ticker.Stop()
 
-	for now := range ticker.C {
+	for {
+		var now time.Time
+		select {
+		case now = <-ticker.C:
+		case <-r.closeChan:
+			r.mutex.Lock()
+			r.garbageCollectorRunning = false
+			r.mutex.Unlock()
+			return
+		}
 		var shouldExit bool
 		r.mutex.Lock()
 		for key, conn := range r.global {
-			if conn.ShouldGarbageCollect(now) {
+			if conn.ShouldGarbageCollect(now, &r.cfg) {
 				conn.Close()
 				delete(r.global, key)
 			}
 		}
 		for ukey, conns := range r.unicast {
 			for key, conn := range conns {
-				if conn.ShouldGarbageCollect(now) {
+				if conn.ShouldGarbageCollect(now, &r.cfg) {
 					conn.Close()
 					delete(conns, key)
 				}
@@ -115,12 +490,134 @@ func (r *reuse) runGarbageCollector() {
 
 // must be called while holding the mutex
 func (r *reuse) maybeStartGarbageCollector() {
-	if !r.garbageCollectorRunning {
+	if !r.garbageCollectorRunning && !r.isClosed() {
 		r.garbageCollectorRunning = true
 		go r.runGarbageCollector()
 	}
 }
 
+// Close closes all connections, including those that are still in use, and stops the garbage collector.
+// Once closed, Dial, DialFromPort, DialFromAddr and Listen return errReuseClosed.
+// If closing any of the connections fails, the returned error contains all errors encountered.
+func (r *reuse) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// Set while holding the mutex, so that no connections are added after the ones below were closed.
+	r.closed = true
+	r.closeOnce.Do(func() { close(r.closeChan) })
+
+	var errs closeErrors
+	for port, conn := range r.global {
+		if err := conn.Close(); err != nil {
+			errs = append(errs, err)
+		}
+		delete(r.global, port)
+	}
+	for ip, conns := range r.unicast {
+		for _, conn := range conns {
+			if err := conn.Close(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		delete(r.unicast, ip)
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+func (r *reuse) isClosed() bool {
+	select {
+	case <-r.closeChan:
+		return true
+	default:
+		return false
+	}
+}
+
+// closeErrors are the errors that occurred when closing multiple connections.
+type closeErrors []error
+
+func (e closeErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return fmt.Sprintf("failed to close %d connections: %s", len(e), strings.Join(msgs, "; "))
+}
+
+// Prune closes connections that are not used any more, keeping the keepN most recently used connections.
+// Connections that are still in use are never closed.
+// It returns the number of connections that were closed.
+func (r *reuse) Prune(keepN int) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	type candidate struct {
+		conn        *reuseConn
+		refCount    int
+		unusedSince time.Time
+		remove      func()
+	}
+	var candidates []candidate
+	for port, conn := range r.global {
+		port := port
+		refCount, unusedSince := conn.usage()
+		candidates = append(candidates, candidate{
+			conn:        conn,
+			refCount:    refCount,
+			unusedSince: unusedSince,
+			remove:      func() { delete(r.global, port) },
+		})
+	}
+	for ip, conns := range r.unicast {
+		ip, conns := ip, conns
+		for port, conn := range conns {
+			port := port
+			refCount, unusedSince := conn.usage()
+			candidates = append(candidates, candidate{
+				conn:        conn,
+				refCount:    refCount,
+				unusedSince: unusedSince,
+				remove: func() {
+					delete(conns, port)
+					if len(conns) == 0 {
+						delete(r.unicast, ip)
+					}
+				},
+			})
+		}
+	}
+	if len(candidates) <= keepN {
+		return 0
+	}
+
+	// Connections that are in use come first, followed by the most recently used ones.
+	sort.Slice(candidates, func(i, j int) bool {
+		ci, cj := candidates[i], candidates[j]
+		if (ci.refCount > 0) != (cj.refCount > 0) {
+			return ci.refCount > 0
+		}
+		return ci.unusedSince.After(cj.unusedSince)
+	})
+	if keepN < 0 {
+		keepN = 0
+	}
+	var num int
+	for _, c := range candidates[keepN:] {
+		// The reference count can't increase, since we're holding the mutex.
+		if c.refCount > 0 {
+			continue
+		}
+		c.conn.Close()
+		c.remove()
+		num++
+	}
+	return num
+}
+
 // Get the source IP that the kernel would use for dialing.
 // This only works on Linux.
 // On other systems, this returns an empty slice of IP addresses.
@@ -142,6 +639,31 @@ func (r *reuse) getSourceIPs(network string, raddr *net.UDPAddr) ([]net.IP, erro
 }
 
 func (r *reuse) Dial(network string, raddr *net.UDPAddr) (*reuseConn, error) {
+	if r.isClosed() {
+		return nil, errReuseClosed
+	}
+	ips, err := r.getSourceIPs(network, raddr)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	conn, err := r.dialLocked(network, ips)
+	if err != nil {
+		return nil, err
+	}
+	r.maybeStartGarbageCollector()
+	return conn, nil
+}
+
+// DialFromPort returns a connection bound to the given local port that can be used for dialing raddr.
+// If there's no such connection yet, a new connection is created on that port.
+func (r *reuse) DialFromPort(network string, raddr *net.UDPAddr, port int) (*reuseConn, error) {
+	if r.isClosed() {
+		return nil, errReuseClosed
+	}
 	ips, err := r.getSourceIPs(network, raddr)
 	if err != nil {
 		return nil, err
@@ -150,80 +672,235 @@ func (r *reuse) Dial(network string, raddr *net.UDPAddr) (*reuseConn, error) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
-	conn, err := r.dialLocked(network, raddr, ips)
+	conn, err := r.dialFromPortLocked(network, ips, port)
 	if err != nil {
 		return nil, err
 	}
-	conn.IncreaseCount()
 	r.maybeStartGarbageCollector()
 	return conn, nil
 }
 
-func (r *reuse) dialLocked(network string, raddr *net.UDPAddr, ips []net.IP) (*reuseConn, error) {
+// must be called while holding the mutex
+func (r *reuse) dialFromPortLocked(network string, ips []net.IP, port int) (*reuseConn, error) {
+	if r.closed {
+		return nil, errReuseClosed
+	}
+	for _, ip := range ips {
+		if conn, ok := r.unicast[ip.String()][port]; ok && conn.isHealthy() {
+			conn.IncreaseCount()
+			return conn, nil
+		}
+	}
+	if conn, ok := r.global[port]; ok && conn.isHealthy() {
+		conn.IncreaseCount()
+		return conn, nil
+	}
+
+	conn, err := net.ListenUDP(r.unspecifiedAddr(network, port))
+	if err != nil {
+		return nil, err
+	}
+	rconn, err := r.newConn(conn)
+	if err != nil {
+		return nil, err
+	}
+	rconn.IncreaseCount()
+	// If port is 0, the kernel picked a port, so the connection must be stored under that one.
+	r.global[conn.LocalAddr().(*net.UDPAddr).Port] = rconn
+	return rconn, nil
+}
+
+// unspecifiedAddr returns the network and the address to use for new connections
+// bound to the unspecified address (0.0.0.0 or ::) and the given port.
+func (r *reuse) unspecifiedAddr(network string, port int) (string, *net.UDPAddr) {
+	if r.cfg.dualStack {
+		// Go creates a dual-stack socket for the "udp" network and the IPv6 unspecified address.
+		return "udp", &net.UDPAddr{IP: net.IPv6unspecified, Port: port}
+	}
+	if network == "udp6" {
+		return network, &net.UDPAddr{IP: net.IPv6zero, Port: port}
+	}
+	return network, &net.UDPAddr{IP: net.IPv4zero, Port: port}
+}
+
+// DialFromAddr returns a connection bound to laddr that can be used for dialing raddr.
+// If laddr has an unspecified IP address, this is equivalent to DialFromPort.
+// Otherwise, only a connection bound to exactly laddr is reused.
+// If there's no such connection yet, a new connection is created on laddr.
+func (r *reuse) DialFromAddr(network string, laddr, raddr *net.UDPAddr) (*reuseConn, error) {
+	if r.isClosed() {
+		return nil, errReuseClosed
+	}
+	if laddr.IP.IsUnspecified() {
+		return r.DialFromPort(network, raddr, laddr.Port)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	conn, err := r.dialFromAddrLocked(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	r.maybeStartGarbageCollector()
+	return conn, nil
+}
+
+// must be called while holding the mutex
+func (r *reuse) dialFromAddrLocked(network string, laddr *net.UDPAddr) (*reuseConn, error) {
+	if r.closed {
+		return nil, errReuseClosed
+	}
+	if conn, ok := r.unicast[laddr.IP.String()][laddr.Port]; ok && laddr.Port != 0 && conn.isHealthy() {
+		conn.IncreaseCount()
+		return conn, nil
+	}
+
+	conn, err := net.ListenUDP(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	rconn, err := r.newConn(conn)
+	if err != nil {
+		return nil, err
+	}
+	rconn.IncreaseCount()
+	r.addConnLocked(conn.LocalAddr().(*net.UDPAddr), rconn)
+	return rconn, nil
+}
+
+// dialLocked returns a connection that can be used for dialing, and increases its reference count.
+// If there are multiple suitable connections, the one with the highest reference count is used.
+// must be called while holding the mutex
+func (r *reuse) dialLocked(network string, ips []net.IP) (*reuseConn, error) {
+	if r.closed {
+		return nil, errReuseClosed
+	}
 	for _, ip := range ips {
 		// We already have at least one suitable connection...
 		if conns, ok := r.unicast[ip.String()]; ok {
-			// ... we don't care which port we're dialing from. Just use the first.
-			for _, c := range conns {
-				return c, nil
+			if conn := findMostUsedLocked(conns); conn != nil {
+				conn.IncreaseCount()
+				return conn, nil
 			}
 		}
 	}
 
 	// Use a connection listening on 0.0.0.0 (or ::).
-	// Again, we don't care about the port number.
-	for _, conn := range r.global {
+	if conn := findMostUsedLocked(r.global); conn != nil {
+		conn.IncreaseCount()
 		return conn, nil
 	}
 
 	// We don't have a connection that we can use for dialing.
 	// Dial a new connection from a random port.
-	var addr *net.UDPAddr
-	switch network {
-	case "udp4":
-		addr = &net.UDPAddr{IP: net.IPv4zero, Port: 0}
-	case "udp6":
-		addr = &net.UDPAddr{IP: net.IPv6zero, Port: 0}
+	conn, err := net.ListenUDP(r.unspecifiedAddr(network, 0))
+	if err != nil {
+		return nil, err
 	}
-	conn, err := net.ListenUDP(network, addr)
+	rconn, err := r.newConn(conn)
 	if err != nil {
 		return nil, err
 	}
-	rconn := newReuseConn(conn)
+	rconn.IncreaseCount()
 	r.global[conn.LocalAddr().(*net.UDPAddr).Port] = rconn
 	return rconn, nil
 }
 
+// maxListenPortFallbacks is the number of ports following the requested port that Listen tries
+// if the requested port is already in use, and port fallback is enabled.
+const maxListenPortFallbacks = 10
+
+func isAddrInUse(err error) bool {
+	opErr, ok := err.(*net.OpError)
+	if !ok {
+		return false
+	}
+	sysErr, ok := opErr.Err.(*os.SyscallError)
+	if !ok {
+		return false
+	}
+	return sysErr.Err == syscall.EADDRINUSE
+}
+
+func (r *reuse) listenUDP(network string, laddr *net.UDPAddr) (*net.UDPConn, error) {
+	conn, err := r.listenUDPOnce(network, laddr)
+	if err == nil || !r.cfg.listenPortFallback || laddr.Port == 0 || !isAddrInUse(err) {
+		return conn, err
+	}
+	for i := 1; i <= maxListenPortFallbacks && laddr.Port+i <= 65535; i++ {
+		addr := *laddr
+		addr.Port += i
+		conn, ferr := r.listenUDPOnce(network, &addr)
+		if ferr == nil {
+			return conn, nil
+		}
+		if !isAddrInUse(ferr) {
+			return nil, ferr
+		}
+	}
+	return nil, err
+}
+
+func (r *reuse) listenUDPOnce(network string, laddr *net.UDPAddr) (*net.UDPConn, error) {
+	if r.cfg.dualStack && laddr.IP.IsUnspecified() {
+		network, laddr = r.unspecifiedAddr(network, laddr.Port)
+	}
+	if !r.cfg.ipFreeBind {
+		return net.ListenUDP(network, laddr)
+	}
+	lc := net.ListenConfig{Control: freeBindControl}
+	conn, err := lc.ListenPacket(context.Background(), network, laddr.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
 func (r *reuse) Listen(network string, laddr *net.UDPAddr) (*reuseConn, error) {
-	conn, err := net.ListenUDP(network, laddr)
+	if r.isClosed() {
+		return nil, errReuseClosed
+	}
+	conn, err := r.listenUDP(network, laddr)
 	if err != nil {
 		return nil, err
 	}
 	localAddr := conn.LocalAddr().(*net.UDPAddr)
 
-	rconn := newReuseConn(conn)
+	rconn, err := r.newConn(conn)
+	if err != nil {
+		return nil, err
+	}
 	rconn.IncreaseCount()
+	rconn.listening = true
 
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
+	if r.closed {
+		rconn.Close()
+		return nil, errReuseClosed
+	}
 	r.maybeStartGarbageCollector()
+	r.addConnLocked(localAddr, rconn)
+	return rconn, nil
+}
 
-	// Deal with listen on a global address
+// addConnLocked adds a connection bound to localAddr to the global or unicast map.
+// must be called while holding the mutex
+func (r *reuse) addConnLocked(localAddr *net.UDPAddr, rconn *reuseConn) {
+	// Deal with a connection on a global address
 	if localAddr.IP.IsUnspecified() {
-		// The kernel already checked that the laddr is not already listen
+		// The kernel already checked that the laddr is not already in use
 		// so we need not check here (when we create ListenUDP).
 		r.global[localAddr.Port] = rconn
-		return rconn, err
+		return
 	}
-
-	// Deal with listen on a unicast address
+	// Deal with a connection on a unicast address
 	if _, ok := r.unicast[localAddr.IP.String()]; !ok {
 		r.unicast[localAddr.IP.String()] = make(map[int]*reuseConn)
 	}
-
-	// The kernel already checked that the laddr is not already listen
+	// The kernel already checked that the laddr is not already in use
 	// so we need not check here (when we create ListenUDP).
 	r.unicast[localAddr.IP.String()][localAddr.Port] = rconn
-	return rconn, err
 }
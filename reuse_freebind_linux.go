@@ -0,0 +1,16 @@
+package libp2pquic
+
+import "syscall"
+
+// freeBindControl sets IP_FREEBIND on a socket before it is bound,
+// allowing it to bind to an address that is not (yet) assigned to an interface.
+// Linux also respects this option for IPv6 sockets.
+func freeBindControl(_, _ string, c syscall.RawConn) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_FREEBIND, 1)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package libp2pquic
+
+import "syscall"
+
+// freeBindControl is a no-op, since IP_FREEBIND is only supported on Linux.
+func freeBindControl(_, _ string, _ syscall.RawConn) error {
+	return nil
+}
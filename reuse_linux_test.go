@@ -0,0 +1,59 @@
+package libp2pquic
+
+import (
+	"net"
+	"syscall"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Reuse socket options", func() {
+	getSockoptInt := func(conn *reuseConn, level, opt int) int {
+		rc, err := conn.PacketConn.(*net.UDPConn).SyscallConn()
+		Expect(err).ToNot(HaveOccurred())
+		var val int
+		var sockErr error
+		Expect(rc.Control(func(fd uintptr) {
+			val, sockErr = syscall.GetsockoptInt(int(fd), level, opt)
+		})).To(Succeed())
+		Expect(sockErr).ToNot(HaveOccurred())
+		return val
+	}
+
+	It("sets the socket buffer sizes", func() {
+		reuse, err := newReuse(reuseConfig{
+			readBufferSize:         8192,
+			writeBufferSize:        16384,
+			garbageCollectInterval: testGarbageCollectInterval,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		addr, err := net.ResolveUDPAddr("udp4", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		conn, err := reuse.Listen("udp4", addr)
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.DecreaseCount()
+		// Linux doubles the value set with setsockopt, to allow space for bookkeeping overhead.
+		Expect(getSockoptInt(conn, syscall.SOL_SOCKET, syscall.SO_RCVBUF)).To(Equal(2 * 8192))
+		Expect(getSockoptInt(conn, syscall.SOL_SOCKET, syscall.SO_SNDBUF)).To(Equal(2 * 16384))
+	})
+
+	It("listens on addresses that are not assigned to an interface with IP_FREEBIND", func() {
+		// 192.0.2.0/24 is reserved for documentation, and not assigned to any interface
+		addr, err := net.ResolveUDPAddr("udp4", "192.0.2.1:0")
+		Expect(err).ToNot(HaveOccurred())
+
+		reuse, err := newReuse(reuseConfig{garbageCollectInterval: testGarbageCollectInterval})
+		Expect(err).ToNot(HaveOccurred())
+		_, err = reuse.Listen("udp4", addr)
+		Expect(err).To(HaveOccurred())
+
+		reuse, err = newReuse(reuseConfig{garbageCollectInterval: testGarbageCollectInterval, ipFreeBind: true})
+		Expect(err).ToNot(HaveOccurred())
+		conn, err := reuse.Listen("udp4", addr)
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.DecreaseCount()
+		Expect(conn.LocalAddr().(*net.UDPAddr).IP.String()).To(Equal("192.0.2.1"))
+		Expect(getSockoptInt(conn, syscall.SOL_IP, syscall.IP_FREEBIND)).To(Equal(1))
+	})
+})
@@ -1,14 +1,25 @@
 package libp2pquic
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net"
 	"runtime"
+	"testing"
 	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
 
+// A failingCloseConn is a net.PacketConn that fails to close.
+type failingCloseConn struct {
+	net.PacketConn
+}
+
+func (c *failingCloseConn) Close() error { return errors.New("close failed") }
+
 func (c *reuseConn) GetCount() int {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
@@ -20,7 +31,7 @@ var _ = Describe("Reuse", func() {
 
 	BeforeEach(func() {
 		var err error
-		reuse, err = newReuse()
+		reuse, err = newReuse(reuseConfig{garbageCollectInterval: testGarbageCollectInterval})
 		Expect(err).ToNot(HaveOccurred())
 	})
 
@@ -85,6 +96,161 @@ var _ = Describe("Reuse", func() {
 			Expect(conn.GetCount()).To(Equal(2))
 		})
 
+		It("reuses a connection on the requested port when dialing from a port", func() {
+			addr, err := net.ResolveUDPAddr("udp4", "0.0.0.0:0")
+			Expect(err).ToNot(HaveOccurred())
+			lconn, err := reuse.Listen("udp4", addr)
+			Expect(err).ToNot(HaveOccurred())
+			port := lconn.LocalAddr().(*net.UDPAddr).Port
+			raddr, err := net.ResolveUDPAddr("udp4", "1.1.1.1:1234")
+			Expect(err).ToNot(HaveOccurred())
+			conn, err := reuse.DialFromPort("udp4", raddr, port)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conn == lconn).To(BeTrue())
+			Expect(conn.GetCount()).To(Equal(2))
+		})
+
+		It("stores connections created when dialing from port 0 under their actual port", func() {
+			raddr, err := net.ResolveUDPAddr("udp4", "1.1.1.1:1234")
+			Expect(err).ToNot(HaveOccurred())
+			conn, err := reuse.DialFromPort("udp4", raddr, 0)
+			Expect(err).ToNot(HaveOccurred())
+			port := conn.LocalAddr().(*net.UDPAddr).Port
+			Expect(port).ToNot(BeZero())
+			reuse.mutex.Lock()
+			Expect(reuse.global).ToNot(HaveKey(0))
+			Expect(reuse.global).To(HaveKeyWithValue(port, conn))
+			reuse.mutex.Unlock()
+			// dialing from port 0 again creates a new connection
+			conn2, err := reuse.DialFromPort("udp4", raddr, 0)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conn2 == conn).To(BeFalse())
+			Expect(reuse.NumConns()).To(Equal(2))
+			// dialing from the actual port reuses the connection
+			conn3, err := reuse.DialFromPort("udp4", raddr, port)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conn3 == conn).To(BeTrue())
+			Expect(conn.GetCount()).To(Equal(2))
+		})
+
+		It("reuses a connection on the requested local address when dialing from an address", func() {
+			addr, err := net.ResolveUDPAddr("udp4", "127.0.0.1:0")
+			Expect(err).ToNot(HaveOccurred())
+			lconn, err := reuse.Listen("udp4", addr)
+			Expect(err).ToNot(HaveOccurred())
+			laddr := lconn.LocalAddr().(*net.UDPAddr)
+			raddr, err := net.ResolveUDPAddr("udp4", "127.0.0.1:1234")
+			Expect(err).ToNot(HaveOccurred())
+			conn, err := reuse.DialFromAddr("udp4", laddr, raddr)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conn == lconn).To(BeTrue())
+			Expect(conn.GetCount()).To(Equal(2))
+		})
+
+		It("creates a new connection on the requested local address when dialing from an address", func() {
+			laddr, err := net.ResolveUDPAddr("udp4", "127.0.0.1:0")
+			Expect(err).ToNot(HaveOccurred())
+			raddr, err := net.ResolveUDPAddr("udp4", "127.0.0.1:1234")
+			Expect(err).ToNot(HaveOccurred())
+			conn, err := reuse.DialFromAddr("udp4", laddr, raddr)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conn.GetCount()).To(Equal(1))
+			boundAddr := conn.LocalAddr().(*net.UDPAddr)
+			Expect(boundAddr.IP.String()).To(Equal("127.0.0.1"))
+			Expect(boundAddr.Port).ToNot(BeZero())
+			// dialing from the same address again reuses the connection
+			conn2, err := reuse.DialFromAddr("udp4", boundAddr, raddr)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conn2 == conn).To(BeTrue())
+			Expect(conn.GetCount()).To(Equal(2))
+		})
+
+		Context("listening on a port that is already in use", func() {
+			var usedConn *net.UDPConn
+
+			BeforeEach(func() {
+				var err error
+				usedConn, err = net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			AfterEach(func() {
+				Expect(usedConn.Close()).To(Succeed())
+			})
+
+			It("fails without port fallback", func() {
+				_, err := reuse.Listen("udp4", usedConn.LocalAddr().(*net.UDPAddr))
+				Expect(err).To(HaveOccurred())
+				Expect(isAddrInUse(err)).To(BeTrue())
+			})
+
+			It("uses one of the following ports with port fallback", func() {
+				reuse.cfg.listenPortFallback = true
+				usedPort := usedConn.LocalAddr().(*net.UDPAddr).Port
+				conn, err := reuse.Listen("udp4", usedConn.LocalAddr().(*net.UDPAddr))
+				Expect(err).ToNot(HaveOccurred())
+				port := conn.LocalAddr().(*net.UDPAddr).Port
+				Expect(port).To(BeNumerically(">", usedPort))
+				Expect(port).To(BeNumerically("<=", usedPort+maxListenPortFallbacks))
+			})
+		})
+
+		It("doesn't reuse a connection whose socket was closed", func() {
+			// listen
+			addr, err := net.ResolveUDPAddr("udp4", "0.0.0.0:0")
+			Expect(err).ToNot(HaveOccurred())
+			lconn, err := reuse.Listen("udp4", addr)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(lconn.PacketConn.Close()).To(Succeed())
+			// dial
+			raddr, err := net.ResolveUDPAddr("udp4", "1.1.1.1:1234")
+			Expect(err).ToNot(HaveOccurred())
+			conn, err := reuse.Dial("udp4", raddr)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conn == lconn).To(BeFalse())
+			Expect(conn.GetCount()).To(Equal(1))
+		})
+
+		It("prefers the unicast connection with the highest reference count", func() {
+			addr, err := net.ResolveUDPAddr("udp4", "127.0.0.1:0")
+			Expect(err).ToNot(HaveOccurred())
+			var conns []*reuseConn
+			for i := 0; i < 5; i++ {
+				conn, err := reuse.Listen("udp4", addr)
+				Expect(err).ToNot(HaveOccurred())
+				conns = append(conns, conn)
+			}
+			conns[3].IncreaseCount()
+			conns[3].IncreaseCount()
+			conns[1].IncreaseCount()
+			for i := 0; i < 10; i++ {
+				reuse.mutex.Lock()
+				conn, err := reuse.dialLocked("udp4", []net.IP{net.IPv4(127, 0, 0, 1)})
+				reuse.mutex.Unlock()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(conn == conns[3]).To(BeTrue())
+			}
+			Expect(conns[3].GetCount()).To(Equal(13))
+		})
+
+		It("prefers the global connection with the highest reference count", func() {
+			addr, err := net.ResolveUDPAddr("udp4", "0.0.0.0:0")
+			Expect(err).ToNot(HaveOccurred())
+			var conns []*reuseConn
+			for i := 0; i < 5; i++ {
+				conn, err := reuse.Listen("udp4", addr)
+				Expect(err).ToNot(HaveOccurred())
+				conns = append(conns, conn)
+			}
+			conns[2].IncreaseCount()
+			reuse.mutex.Lock()
+			conn, err := reuse.dialLocked("udp4", nil)
+			reuse.mutex.Unlock()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conn == conns[2]).To(BeTrue())
+			Expect(conn.GetCount()).To(Equal(3))
+		})
+
 		if runtime.GOOS == "linux" {
 			It("reuses a connection it created for listening on a specific interface", func() {
 				raddr, err := net.ResolveUDPAddr("udp4", "1.1.1.1:1234")
@@ -104,6 +270,176 @@ var _ = Describe("Reuse", func() {
 				Expect(conn.GetCount()).To(Equal(2))
 			})
 		}
+
+		It("creates a single connection when dialing concurrently", func() {
+			const num = 10
+			conns := make(chan *reuseConn, num)
+			for i := 0; i < num; i++ {
+				go func() {
+					defer GinkgoRecover()
+					conn, err := reuse.Dial("udp4", &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 1234})
+					Expect(err).ToNot(HaveOccurred())
+					conns <- conn
+				}()
+			}
+			first := <-conns
+			for i := 1; i < num; i++ {
+				Expect(<-conns).To(Equal(first))
+			}
+			reuse.mutex.Lock()
+			Expect(reuse.global).To(HaveLen(1))
+			reuse.mutex.Unlock()
+			Expect(first.GetCount()).To(Equal(num))
+		})
+	})
+
+	Context("pruning connections", func() {
+		var conns []*reuseConn
+
+		BeforeEach(func() {
+			// make sure that the garbage collector doesn't interfere
+			maxUnusedDuration = time.Hour
+			conns = nil
+			for i := 0; i < 5; i++ {
+				addr, err := net.ResolveUDPAddr("udp4", "0.0.0.0:0")
+				Expect(err).ToNot(HaveOccurred())
+				conn, err := reuse.Listen("udp4", addr)
+				Expect(err).ToNot(HaveOccurred())
+				conns = append(conns, conn)
+			}
+			Expect(reuse.NumConns()).To(Equal(5))
+		})
+
+		AfterEach(func() {
+			for _, conn := range conns {
+				for conn.GetCount() > 0 {
+					conn.DecreaseCount()
+				}
+			}
+			reuse.Prune(0)
+		})
+
+		It("only closes unused connections", func() {
+			for _, conn := range conns[:3] {
+				conn.DecreaseCount()
+			}
+			Expect(reuse.Prune(2)).To(Equal(3))
+			Expect(reuse.NumConns()).To(Equal(2))
+			for _, conn := range conns[:3] {
+				Expect(conn.isHealthy()).To(BeFalse())
+			}
+			for _, conn := range conns[3:] {
+				Expect(conn.isHealthy()).To(BeTrue())
+			}
+		})
+
+		It("keeps the most recently used connections", func() {
+			for _, conn := range conns[:3] {
+				conn.DecreaseCount()
+				time.Sleep(time.Millisecond) // make sure the unusedSince timestamps differ
+			}
+			Expect(reuse.Prune(3)).To(Equal(2))
+			Expect(reuse.NumConns()).To(Equal(3))
+			Expect(conns[0].isHealthy()).To(BeFalse())
+			Expect(conns[1].isHealthy()).To(BeFalse())
+			Expect(conns[2].isHealthy()).To(BeTrue())
+		})
+	})
+
+	It("doesn't truncate large packets when using receive workers", func() {
+		reuse.cfg.receiveWorkers = 2
+		defer reuse.Close()
+		conn, err := reuse.Listen("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		Expect(err).ToNot(HaveOccurred())
+		sender, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		Expect(err).ToNot(HaveOccurred())
+		defer sender.Close()
+		packet := make([]byte, 4000)
+		packet[len(packet)-1] = 42
+		_, err = sender.WriteTo(packet, conn.LocalAddr())
+		Expect(err).ToNot(HaveOccurred())
+		buf := make([]byte, 5000)
+		n, _, err := conn.ReadFrom(buf)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(buf[:n]).To(Equal(packet))
+	})
+
+	It("closes all connections", func() {
+		reuse.cfg.garbageCollectInterval = time.Hour
+		addr, err := net.ResolveUDPAddr("udp4", "0.0.0.0:0")
+		Expect(err).ToNot(HaveOccurred())
+		gconn, err := reuse.Listen("udp4", addr)
+		Expect(err).ToNot(HaveOccurred())
+		addr, err = net.ResolveUDPAddr("udp4", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		uconn, err := reuse.Listen("udp4", addr)
+		Expect(err).ToNot(HaveOccurred())
+		reuse.mutex.Lock()
+		reuse.global[1234] = newReuseConn(&failingCloseConn{})
+		reuse.mutex.Unlock()
+		Eventually(isGarbageCollectorRunning).Should(BeTrue())
+
+		err = reuse.Close()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("close failed"))
+		Expect(gconn.isHealthy()).To(BeFalse())
+		Expect(uconn.isHealthy()).To(BeFalse())
+		Expect(reuse.NumConns()).To(BeZero())
+		// the garbage collector is stopped right away, without waiting for the next tick
+		Eventually(isGarbageCollectorRunning).Should(BeFalse())
+
+		_, err = reuse.Listen("udp4", addr)
+		Expect(err).To(MatchError(errReuseClosed))
+		raddr, err := net.ResolveUDPAddr("udp4", "1.1.1.1:1234")
+		Expect(err).ToNot(HaveOccurred())
+		_, err = reuse.Dial("udp4", raddr)
+		Expect(err).To(MatchError(errReuseClosed))
+		_, err = reuse.DialFromPort("udp4", raddr, 1234)
+		Expect(err).To(MatchError(errReuseClosed))
+		Expect(reuse.Close()).To(Succeed())
+	})
+
+	It("doesn't add connections when dialing concurrently with Close", func() {
+		raddr, err := net.ResolveUDPAddr("udp4", "1.1.1.1:1234")
+		Expect(err).ToNot(HaveOccurred())
+		const num = 10
+		conns := make(chan *reuseConn, num)
+		for i := 0; i < num; i++ {
+			go func() {
+				defer GinkgoRecover()
+				conn, err := reuse.DialFromAddr("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, raddr)
+				if err != nil {
+					Expect(err).To(MatchError(errReuseClosed))
+				}
+				conns <- conn
+			}()
+		}
+		Expect(reuse.Close()).To(Succeed())
+		for i := 0; i < num; i++ {
+			var conn *reuseConn
+			Eventually(conns).Should(Receive(&conn))
+			if conn != nil {
+				Expect(conn.isHealthy()).To(BeFalse())
+			}
+		}
+		Expect(reuse.NumConns()).To(BeZero())
+	})
+
+	It("garbage collects connections independently of other reuse instances", func() {
+		slowReuse, err := newReuse(reuseConfig{garbageCollectInterval: time.Second})
+		Expect(err).ToNot(HaveOccurred())
+		addr, err := net.ResolveUDPAddr("udp4", "0.0.0.0:0")
+		Expect(err).ToNot(HaveOccurred())
+		conn, err := reuse.Listen("udp4", addr)
+		Expect(err).ToNot(HaveOccurred())
+		slowConn, err := slowReuse.Listen("udp4", addr)
+		Expect(err).ToNot(HaveOccurred())
+
+		conn.DecreaseCount()
+		slowConn.DecreaseCount()
+		Eventually(reuse.NumConns, 500*time.Millisecond).Should(BeZero())
+		Expect(slowReuse.NumConns()).To(Equal(1))
+		Eventually(slowReuse.NumConns, 2*time.Second).Should(BeZero())
 	})
 
 	Context("garbage-collecting connections", func() {
@@ -113,10 +449,46 @@ var _ = Describe("Reuse", func() {
 			return len(reuse.global)
 		}
 
+		contains := func(conn *reuseConn) func() bool {
+			return func() bool {
+				reuse.mutex.Lock()
+				defer reuse.mutex.Unlock()
+				for _, c := range reuse.global {
+					if c == conn {
+						return true
+					}
+				}
+				for _, conns := range reuse.unicast {
+					for _, c := range conns {
+						if c == conn {
+							return true
+						}
+					}
+				}
+				return false
+			}
+		}
+
 		BeforeEach(func() {
 			maxUnusedDuration = 100 * time.Millisecond
 		})
 
+		It("counts connections", func() {
+			addr, err := net.ResolveUDPAddr("udp4", "0.0.0.0:0")
+			Expect(err).ToNot(HaveOccurred())
+			gconn, err := reuse.Listen("udp4", addr)
+			Expect(err).ToNot(HaveOccurred())
+			addr, err = net.ResolveUDPAddr("udp4", "127.0.0.1:0")
+			Expect(err).ToNot(HaveOccurred())
+			uconn, err := reuse.Listen("udp4", addr)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reuse.NumConns()).To(Equal(2))
+
+			gconn.DecreaseCount()
+			uconn.DecreaseCount()
+			Eventually(reuse.NumConns).Should(BeZero())
+		})
+
 		It("garbage collects connections once they're not used any more for a certain time", func() {
 			addr, err := net.ResolveUDPAddr("udp4", "0.0.0.0:0")
 			Expect(err).ToNot(HaveOccurred())
@@ -138,6 +510,69 @@ var _ = Describe("Reuse", func() {
 			Eventually(numGlobals).Should(BeZero())
 		})
 
+		It("keeps connections that carried a lot of traffic for longer", func() {
+			reuse.cfg.gcUtilizationFactor = 10
+			defer reuse.Close()
+			addr, err := net.ResolveUDPAddr("udp4", "0.0.0.0:0")
+			Expect(err).ToNot(HaveOccurred())
+			busyConn, err := reuse.Listen("udp4", addr)
+			Expect(err).ToNot(HaveOccurred())
+			idleConn, err := reuse.Listen("udp4", addr)
+			Expect(err).ToNot(HaveOccurred())
+
+			// The busy connection was used for a second at full utilization,
+			// so it's kept for 10 seconds after it's not used any more.
+			busyConn.createdAt = time.Now().Add(-time.Second)
+			busyConn.totalBytesWritten = 10 * highUtilizationThroughput
+			busyConn.DecreaseCount()
+			idleConn.DecreaseCount()
+			Eventually(contains(idleConn)).Should(BeFalse())
+			Consistently(contains(busyConn), 3*maxUnusedDuration).Should(BeTrue())
+		})
+
+		It("garbage collects connections that are still referenced, but only by closed sessions", func() {
+			reuse.cfg.collectStaleConns = true
+			defer reuse.Close()
+			addr, err := net.ResolveUDPAddr("udp4", "127.0.0.1:0")
+			Expect(err).ToNot(HaveOccurred())
+			staleConn, err := reuse.DialFromAddr("udp4", addr, nil)
+			Expect(err).ToNot(HaveOccurred())
+			closedCtx, cancel := context.WithCancel(context.Background())
+			cancel()
+			staleConn.AddSession(closedCtx)
+
+			liveConn, err := reuse.DialFromAddr("udp4", addr, nil)
+			Expect(err).ToNot(HaveOccurred())
+			liveCtx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			liveConn.AddSession(liveCtx)
+			// a dial that's still in progress
+			dialingConn, err := reuse.DialFromAddr("udp4", addr, nil)
+			Expect(err).ToNot(HaveOccurred())
+			// an idle listener
+			listenConn, err := reuse.Listen("udp4", addr)
+			Expect(err).ToNot(HaveOccurred())
+
+			Eventually(contains(staleConn)).Should(BeFalse())
+			Expect(staleConn.isHealthy()).To(BeFalse())
+			Consistently(func() bool {
+				return contains(liveConn)() && contains(dialingConn)() && contains(listenConn)()
+			}, 3*maxUnusedDuration).Should(BeTrue())
+
+			// once the session is closed, the connection is collected
+			cancel()
+			Eventually(contains(liveConn)).Should(BeFalse())
+			// once the listener is closed, the connection isn't collected while a session is still alive
+			ctx, cancel2 := context.WithCancel(context.Background())
+			defer cancel2()
+			listenConn.IncreaseCount()
+			listenConn.AddSession(ctx)
+			listenConn.StopListening()
+			Consistently(contains(listenConn), 3*maxUnusedDuration).Should(BeTrue())
+			cancel2()
+			Eventually(contains(listenConn)).Should(BeFalse())
+		})
+
 		It("only stops the garbage collector when there are no more connections", func() {
 			addr1, err := net.ResolveUDPAddr("udp4", "0.0.0.0:0")
 			Expect(err).ToNot(HaveOccurred())
@@ -157,3 +592,102 @@ var _ = Describe("Reuse", func() {
 		})
 	})
 })
+
+func BenchmarkReuseDial_Serial(b *testing.B) {
+	r, err := newReuse(reuseConfig{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer r.Close()
+	raddr := &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 1234}
+	b.ReportAllocs()
+	defer b.StopTimer()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn, err := r.Dial("udp4", raddr)
+		if err != nil {
+			b.Fatal(err)
+		}
+		conn.DecreaseCount()
+	}
+}
+
+func BenchmarkReuseDial_Concurrent(b *testing.B) {
+	for _, procs := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("GOMAXPROCS=%d", procs), func(b *testing.B) {
+			defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(procs))
+			r, err := newReuse(reuseConfig{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer r.Close()
+			raddr := &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 1234}
+			b.ReportAllocs()
+			defer b.StopTimer()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					conn, err := r.Dial("udp4", raddr)
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					conn.DecreaseCount()
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkReceiveWorkers(b *testing.B) {
+	for _, workers := range []int{1, 4} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			benchmarkReceiveWorkers(b, workers)
+		})
+	}
+}
+
+func benchmarkReceiveWorkers(b *testing.B, workers int) {
+	const packetSize = 1200
+	r, err := newReuse(reuseConfig{receiveWorkers: workers})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer r.Close()
+	conn, err := r.Listen("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	// Keep sending packets until the benchmark is done, since the kernel might drop some of them.
+	done := make(chan struct{})
+	defer close(done)
+	for i := 0; i < 4; i++ {
+		sender, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer sender.Close()
+		go func() {
+			packet := make([]byte, packetSize)
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				sender.WriteTo(packet, conn.LocalAddr())
+			}
+		}()
+	}
+
+	b.SetBytes(packetSize)
+	defer b.StopTimer()
+	b.ResetTimer()
+	buf := make([]byte, receiveBufferSize)
+	for i := 0; i < b.N; i++ {
+		if _, _, err := conn.ReadFrom(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package libp2pquic
+
+import "time"
+
+// A StatsCollector collects metrics about the connections of a transport.
+// Its methods may be called concurrently.
+type StatsCollector interface {
+	// IncrDialed is called when a dial succeeds.
+	IncrDialed()
+	// IncrDialError is called when a dial fails.
+	IncrDialError()
+	// IncrAccepted is called when a listener accepts a connection.
+	IncrAccepted()
+	// RecordHandshakeDuration is called with the duration of the QUIC handshake of a successful dial.
+	RecordHandshakeDuration(time.Duration)
+	// RecordStreamCount is called with the number of open streams on all connections of the transport,
+	// whenever a stream is opened, accepted, closed or reset.
+	RecordStreamCount(n int)
+}
+
+type noopStatsCollector struct{}
+
+var _ StatsCollector = noopStatsCollector{}
+
+func (noopStatsCollector) IncrDialed()                           {}
+func (noopStatsCollector) IncrDialError()                        {}
+func (noopStatsCollector) IncrAccepted()                         {}
+func (noopStatsCollector) RecordHandshakeDuration(time.Duration) {}
+func (noopStatsCollector) RecordStreamCount(int)                 {}
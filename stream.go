@@ -1,19 +1,167 @@
 package libp2pquic
 
 import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+
 	"github.com/libp2p/go-libp2p-core/mux"
+	"github.com/libp2p/go-libp2p-core/network"
 
 	quic "github.com/lucas-clemente/quic-go"
 )
 
 type stream struct {
 	quic.Stream
+
+	// errorMapper, if set, translates errors returned by Read and Write.
+	errorMapper func(error) error
+	// onDone, if set, is called once when the stream is closed or reset.
+	onDone   func()
+	doneOnce sync.Once
+	// onFinished, if set, is called once both directions of the stream are finished,
+	// i.e. once reading returned an error, and the write side was closed or canceled, locally or by the peer.
+	onFinished   func()
+	readDoneOnce sync.Once
+	finishedOnce sync.Once
 }
 
 var _ mux.MuxedStream = &stream{}
 
+func (s *stream) Read(b []byte) (int, error) {
+	n, err := s.Stream.Read(b)
+	if err != nil {
+		if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+			s.readDone()
+		}
+	}
+	return n, s.mapError(err)
+}
+
+func (s *stream) Write(b []byte) (int, error) {
+	n, err := s.Stream.Write(b)
+	return n, s.mapError(err)
+}
+
+func (s *stream) mapError(err error) error {
+	if err == nil || err == io.EOF || s.errorMapper == nil {
+		return err
+	}
+	return s.errorMapper(err)
+}
+
+func (s *stream) Close() error {
+	err := s.Stream.Close()
+	s.done()
+	return err
+}
+
 func (s *stream) Reset() error {
 	s.Stream.CancelRead(0)
 	s.Stream.CancelWrite(0)
+	s.done()
+	s.finished()
 	return nil
 }
+
+// CancelRead aborts receiving on the stream.
+// The stream is finished once the write side is closed as well.
+func (s *stream) CancelRead(code quic.ErrorCode) {
+	s.Stream.CancelRead(code)
+	s.readDone()
+}
+
+func (s *stream) done() {
+	if s.onDone != nil {
+		s.doneOnce.Do(s.onDone)
+	}
+}
+
+// readDone is called once reading from the stream returned an error, or io.EOF, or was canceled.
+// The stream is finished once the write side is closed as well.
+// The stream's context is canceled when the write side is closed, or canceled by the peer.
+func (s *stream) readDone() {
+	s.readDoneOnce.Do(func() {
+		ctx := s.Stream.Context()
+		select {
+		case <-ctx.Done():
+			s.finished()
+		default:
+			go func() {
+				<-ctx.Done()
+				s.finished()
+			}()
+		}
+	})
+}
+
+func (s *stream) finished() {
+	if s.onFinished != nil {
+		s.finishedOnce.Do(s.onFinished)
+	}
+}
+
+type receiveStream struct {
+	quic.ReceiveStream
+}
+
+var _ io.ReadCloser = &receiveStream{}
+
+// Close stops reading from the stream.
+func (s *receiveStream) Close() error {
+	s.ReceiveStream.CancelRead(0)
+	return nil
+}
+
+// A StreamObserver is notified when streams are opened and closed.
+type StreamObserver interface {
+	OnStreamOpen(connID, streamID string, dir network.Direction)
+	// OnStreamClose is called when the stream is closed or reset,
+	// with the number of bytes read from and written to the stream until then.
+	OnStreamClose(connID, streamID string, bytesRead, bytesWritten int64)
+}
+
+// A telemetryStream counts the bytes transferred on a stream, and reports them to a StreamObserver.
+type telemetryStream struct {
+	// accessed atomically. Keep them first to guarantee 64 bit alignment on 32 bit platforms.
+	bytesRead, bytesWritten int64
+
+	*stream
+
+	observer         StreamObserver
+	connID, streamID string
+	closeOnce        sync.Once
+}
+
+var _ mux.MuxedStream = &telemetryStream{}
+
+func (s *telemetryStream) Read(b []byte) (int, error) {
+	n, err := s.stream.Read(b)
+	atomic.AddInt64(&s.bytesRead, int64(n))
+	return n, err
+}
+
+func (s *telemetryStream) Write(b []byte) (int, error) {
+	n, err := s.stream.Write(b)
+	atomic.AddInt64(&s.bytesWritten, int64(n))
+	return n, err
+}
+
+func (s *telemetryStream) Close() error {
+	err := s.stream.Close()
+	s.notifyClosed()
+	return err
+}
+
+func (s *telemetryStream) Reset() error {
+	err := s.stream.Reset()
+	s.notifyClosed()
+	return err
+}
+
+func (s *telemetryStream) notifyClosed() {
+	s.closeOnce.Do(func() {
+		s.observer.OnStreamClose(s.connID, s.streamID, atomic.LoadInt64(&s.bytesRead), atomic.LoadInt64(&s.bytesWritten))
+	})
+}
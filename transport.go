@@ -3,10 +3,17 @@ package libp2pquic
 import (
 	"context"
 	"errors"
+	"fmt"
+	mrand "math/rand"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
 	tpt "github.com/libp2p/go-libp2p-core/transport"
 	p2ptls "github.com/libp2p/go-libp2p-tls"
 
@@ -28,17 +35,59 @@ var quicConfig = &quic.Config{
 	KeepAlive: true,
 }
 
+var quicDialContext = quic.DialContext // so we can mock it in tests
+
+// ErrDialCancelled is returned by Dial if the context is canceled,
+// or its deadline expires, before the QUIC handshake completes.
+// The returned error also wraps the context's error.
+var ErrDialCancelled = errors.New("dial cancelled")
+
+type dialCancelledError struct {
+	err error
+}
+
+func (e *dialCancelledError) Error() string        { return ErrDialCancelled.Error() + ": " + e.err.Error() }
+func (e *dialCancelledError) Unwrap() error        { return e.err }
+func (e *dialCancelledError) Is(target error) bool { return target == ErrDialCancelled }
+
+// ErrTooManyPendingDials is returned by Dial if the number of dials to the peer that are in progress
+// reached the limit set by WithMaxPendingDialsPerPeer.
+var ErrTooManyPendingDials = errors.New("too many pending dials to peer")
+
+// ErrKeyExchangeTimeout is returned by Dial if the peer's public key wasn't available
+// within the timeout set by WithKeyExchangeTimeout after the handshake completed.
+var ErrKeyExchangeTimeout = errors.New("timeout waiting for the peer's public key")
+
+// ErrTransportClosed is returned by Dial if the transport was closed using Close or CloseContext.
+var ErrTransportClosed = errors.New("transport closed")
+
+// ErrPeerBlacklisted is returned by Dial if the peer was blacklisted using BlacklistPeer.
+var ErrPeerBlacklisted = errors.New("peer blacklisted")
+
+// errorCodeConnectionGating is the application error code used to close
+// connections from blacklisted peers.
+const errorCodeConnectionGating = 0x47
+
+// dialMatcher matches QUIC multiaddrs, including scoped IPv6 addresses (/ip6zone/<zone>/ip6/...).
+var dialMatcher = mafmt.Or(
+	mafmt.QUIC,
+	mafmt.And(mafmt.Base(ma.P_IP6ZONE), mafmt.Base(ma.P_IP6), mafmt.Base(ma.P_UDP), mafmt.Base(ma.P_QUIC)),
+)
+
 type connManager struct {
 	reuseUDP4 *reuse
 	reuseUDP6 *reuse
 }
 
-func newConnManager() (*connManager, error) {
-	reuseUDP4, err := newReuse()
+func newConnManager(cfg reuseConfig) (*connManager, error) {
+	// Only IPv6 sockets can be dual-stack.
+	cfg4 := cfg
+	cfg4.dualStack = false
+	reuseUDP4, err := newReuse(cfg4)
 	if err != nil {
 		return nil, err
 	}
-	reuseUDP6, err := newReuse()
+	reuseUDP6, err := newReuse(cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -59,6 +108,15 @@ func (c *connManager) getReuse(network string) (*reuse, error) {
 	}
 }
 
+// getDialReuse returns the reuse used for dialing.
+// If the IPv6 reuse uses dual-stack sockets, IPv4 addresses are dialed from those sockets as well.
+func (c *connManager) getDialReuse(network string) (*reuse, error) {
+	if network == "udp4" && c.reuseUDP6.cfg.dualStack {
+		return c.reuseUDP6, nil
+	}
+	return c.getReuse(network)
+}
+
 func (c *connManager) Listen(network string, laddr *net.UDPAddr) (*reuseConn, error) {
 	reuse, err := c.getReuse(network)
 	if err != nil {
@@ -67,26 +125,191 @@ func (c *connManager) Listen(network string, laddr *net.UDPAddr) (*reuseConn, er
 	return reuse.Listen(network, laddr)
 }
 
+// NumConns returns the number of UDP sockets tracked for IPv4 and for IPv6.
+func (c *connManager) NumConns() (udp4, udp6 int) {
+	return c.reuseUDP4.NumConns(), c.reuseUDP6.NumConns()
+}
+
+// Close closes all UDP sockets.
+func (c *connManager) Close() error {
+	err4 := c.reuseUDP4.Close()
+	err6 := c.reuseUDP6.Close()
+	if err4 != nil {
+		return err4
+	}
+	return err6
+}
+
 func (c *connManager) Dial(network string, raddr *net.UDPAddr) (*reuseConn, error) {
-	reuse, err := c.getReuse(network)
+	reuse, err := c.getDialReuse(network)
 	if err != nil {
 		return nil, err
 	}
 	return reuse.Dial(network, raddr)
 }
 
+// DialFromPort returns a connection bound to the given local port that can be used for dialing raddr.
+func (c *connManager) DialFromPort(network string, raddr *net.UDPAddr, port int) (*reuseConn, error) {
+	reuse, err := c.getDialReuse(network)
+	if err != nil {
+		return nil, err
+	}
+	return reuse.DialFromPort(network, raddr, port)
+}
+
+// A dialConn is the socket a connection is dialed from.
+// DecreaseCount is called once the connection doesn't use it any more.
+type dialConn interface {
+	net.PacketConn
+	DecreaseCount()
+}
+
+var _ dialConn = &reuseConn{}
+
+// A noreuseConn is a socket created by the dialer set with WithContextDialer.
+// It is only used for a single connection, and closed once that connection is closed.
+type noreuseConn struct {
+	net.Conn
+}
+
+var _ dialConn = &noreuseConn{}
+
+// ReadFrom reads a packet. The address returned is the remote address of the net.Conn.
+func (c *noreuseConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, err := c.Read(b)
+	return n, c.RemoteAddr(), err
+}
+
+// WriteTo writes a packet. The net.Conn is already connected to the peer, so addr is ignored.
+func (c *noreuseConn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	return c.Write(b)
+}
+
+// DecreaseCount closes the net.Conn.
+func (c *noreuseConn) DecreaseCount() {
+	c.Close()
+}
+
+type sourcePortKey struct{}
+
+// WithSourcePort returns a context that makes Dial use a UDP socket bound to the given local port.
+// If the transport doesn't have such a socket yet, it creates one.
+func WithSourcePort(ctx context.Context, port int) context.Context {
+	return context.WithValue(ctx, sourcePortKey{}, port)
+}
+
+func sourcePortFromContext(ctx context.Context) (int, bool) {
+	port, ok := ctx.Value(sourcePortKey{}).(int)
+	return port, ok
+}
+
+// A QUICTransport is a tpt.Transport for QUIC connections.
+type QUICTransport interface {
+	tpt.Transport
+	// LocalPeerID returns the peer ID of the local node.
+	LocalPeerID() peer.ID
+	// DialAsync dials a peer in the background.
+	// The result is sent on the returned channel once the dial completed.
+	DialAsync(ctx context.Context, raddr ma.Multiaddr, p peer.ID) <-chan DialResult
+	// WarmUp dials a peer, and keeps the connection until Dial is called for the same peer and address.
+	WarmUp(ctx context.Context, p peer.ID, raddr ma.Multiaddr) error
+	// CancelDial cancels all dials to a peer on an address that are in progress.
+	CancelDial(p peer.ID, raddr ma.Multiaddr) int
+	// InjectTransportContext returns a context that carries information about this transport.
+	InjectTransportContext(ctx context.Context) context.Context
+	// BlacklistPeer prevents connections to and from a peer.
+	BlacklistPeer(p peer.ID)
+	// UnblacklistPeer removes a peer from the blacklist.
+	UnblacklistPeer(p peer.ID)
+	// ConnsToPeer returns the connections to a peer that were accepted by this transport's listeners.
+	ConnsToPeer(p peer.ID) []tpt.CapableConn
+	// ClosePeer closes all connections to a peer that were accepted by this transport's listeners.
+	ClosePeer(p peer.ID) error
+	// DrainPeer gracefully closes all connections to a peer that were accepted by this transport's listeners.
+	DrainPeer(ctx context.Context, p peer.ID) error
+	// Close closes all UDP sockets used by the transport, without waiting for connections to be closed.
+	Close() error
+	// CloseContext waits until all connections are closed, or until the context is done,
+	// and then closes all UDP sockets used by the transport.
+	CloseContext(ctx context.Context) error
+}
+
+// A DialResult is the result of a dial started with DialAsync.
+type DialResult struct {
+	Conn tpt.CapableConn
+	Err  error
+}
+
 // The Transport implements the tpt.Transport interface for QUIC connections.
 type transport struct {
+	numStreams int32 // number of open streams on all connections, accessed atomically
+
 	privKey     ic.PrivKey
 	localPeer   peer.ID
 	identity    *p2ptls.Identity
 	connManager *connManager
+	quicConfig  *quic.Config
+	created     time.Time
+
+	peerIDVerifier    func(peer.ID) error
+	handshakeTimeout  time.Duration
+	connectTimeout    time.Duration
+	retryAttempts     int
+	retryBackoff      time.Duration
+	retryMaxBackoff   time.Duration
+	streamObserver    StreamObserver
+	streamErrorMapper func(error) error
+	stats             StatsCollector
+	addrBook          peerstore.AddrBook
+
+	peerScorer           func(peer.ID) float64
+	acceptScoreThreshold float64
+	acceptWorkers        int
+	keyExchangeTimeout   time.Duration
+
+	listenerErrorHandler func(error)
+	connLogger           func(peer.ID, net.Addr, network.Direction, error)
+	contextDialer        func(ctx context.Context, addr string) (net.Conn, error)
+	connInterceptors     []func(tpt.CapableConn) (tpt.CapableConn, error)
+
+	blacklist sync.Map // peer.ID -> struct{}
+
+	closeMutex sync.Mutex
+	closed     bool // set by Close and CloseContext. Once set, no sessions are added.
+	// sessions counts the sessions of dialed and accepted connections that haven't ended yet
+	sessions sync.WaitGroup
+
+	warmConnsMutex sync.Mutex
+	// warmConns contains the connections dialed by WarmUp, that weren't returned by Dial yet
+	warmConns map[dialKey]*conn
+
+	pendingDialsMutex sync.Mutex
+	// pendingDials contains the dials started by Dial that haven't returned yet
+	pendingDials map[dialKey][]*pendingDial
+	// numPendingDials counts the pending dials per peer
+	numPendingDials        map[peer.ID]int
+	maxPendingDialsPerPeer int
+
+	connsMutex sync.RWMutex
+	// conns contains the connections accepted by this transport's listeners
+	conns map[peer.ID][]*conn
 }
 
-var _ tpt.Transport = &transport{}
+var _ QUICTransport = &transport{}
 
 // NewTransport creates a new QUIC transport
-func NewTransport(key ic.PrivKey) (tpt.Transport, error) {
+func NewTransport(key ic.PrivKey, opts ...Option) (tpt.Transport, error) {
+	qconf := *quicConfig
+	cfg := config{quicConfig: &qconf}
+	if err := cfg.apply(opts...); err != nil {
+		return nil, err
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	for _, mutate := range cfg.quicConfigMutators {
+		mutate(cfg.quicConfig)
+	}
 	localPeer, err := peer.IDFromPrivateKey(key)
 	if err != nil {
 		return nil, err
@@ -95,7 +318,22 @@ func NewTransport(key ic.PrivKey) (tpt.Transport, error) {
 	if err != nil {
 		return nil, err
 	}
-	connManager, err := newConnManager()
+	stats := cfg.statsCollector
+	if stats == nil {
+		stats = noopStatsCollector{}
+	}
+	connManager, err := newConnManager(reuseConfig{
+		readBufferSize:         cfg.readBufferSize,
+		writeBufferSize:        cfg.writeBufferSize,
+		garbageCollectInterval: cfg.garbageCollectInterval,
+		packetInterceptor:      cfg.packetInterceptor,
+		listenPortFallback:     cfg.listenPortFallback,
+		gcUtilizationFactor:    cfg.gcUtilizationFactor,
+		collectStaleConns:      cfg.collectStaleSockets,
+		ipFreeBind:             cfg.ipFreeBind,
+		receiveWorkers:         cfg.receiveWorkers,
+		dualStack:              cfg.dualStackReuse,
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -105,11 +343,317 @@ func NewTransport(key ic.PrivKey) (tpt.Transport, error) {
 		localPeer:   localPeer,
 		identity:    identity,
 		connManager: connManager,
+		quicConfig:  cfg.quicConfig,
+		created:     time.Now(),
+
+		peerIDVerifier:    cfg.peerIDVerifier,
+		handshakeTimeout:  cfg.handshakeTimeout,
+		connectTimeout:    cfg.connectTimeout,
+		retryAttempts:     cfg.retryAttempts,
+		retryBackoff:      cfg.retryBackoff,
+		retryMaxBackoff:   cfg.retryMaxBackoff,
+		streamObserver:    cfg.streamObserver,
+		streamErrorMapper: cfg.streamErrorMapper,
+		stats:             stats,
+		addrBook:          cfg.addrBook,
+		conns:             make(map[peer.ID][]*conn),
+		warmConns:         make(map[dialKey]*conn),
+		pendingDials:      make(map[dialKey][]*pendingDial),
+
+		listenerErrorHandler: cfg.listenerErrorHandler,
+		connLogger:           cfg.connLogger,
+		contextDialer:        cfg.contextDialer,
+		connInterceptors:     cfg.connInterceptors,
+		peerScorer:           cfg.peerScorer,
+		acceptScoreThreshold: cfg.acceptScoreThreshold,
+		acceptWorkers:        cfg.acceptWorkers,
+		keyExchangeTimeout:   cfg.keyExchangeTimeout,
+
+		numPendingDials:        make(map[peer.ID]int),
+		maxPendingDialsPerPeer: cfg.maxPendingDialsPerPeer,
 	}, nil
 }
 
-// Dial dials a new QUIC connection
+// A dialKey identifies dials to a peer on an address.
+type dialKey struct {
+	peer peer.ID
+	addr string
+}
+
+type pendingDial struct {
+	cancel context.CancelFunc
+}
+
+// Dial dials a new QUIC connection.
+// If a connection to the peer and address was established by WarmUp, that connection is returned.
+// The dial can be canceled using CancelDial.
 func (t *transport) Dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (tpt.CapableConn, error) {
+	if t.isClosed() {
+		t.stats.IncrDialError()
+		t.logDial(p, raddr, ErrTransportClosed)
+		return nil, ErrTransportClosed
+	}
+	if t.isBlacklisted(p) {
+		t.closeWarmConnsTo(p)
+		t.stats.IncrDialError()
+		t.logDial(p, raddr, ErrPeerBlacklisted)
+		return nil, ErrPeerBlacklisted
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	key := dialKey{peer: p, addr: raddr.String()}
+	pd, err := t.addPendingDial(key, cancel)
+	if err != nil {
+		t.stats.IncrDialError()
+		t.logDial(p, raddr, err)
+		return nil, err
+	}
+	defer t.removePendingDial(key, pd)
+
+	if c := t.takeWarmConn(p, raddr); c != nil {
+		conn, err := t.interceptConn(c)
+		t.logDial(p, raddr, err)
+		if err != nil {
+			t.stats.IncrDialError()
+			return nil, err
+		}
+		t.stats.IncrDialed()
+		return conn, nil
+	}
+
+	if t.connectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.connectTimeout)
+		defer cancel()
+	}
+	c, err := t.dialWithRetries(ctx, raddr, p)
+	if err == nil {
+		c, err = t.interceptConn(c)
+	}
+	t.logDial(p, raddr, err)
+	if err != nil {
+		t.stats.IncrDialError()
+		return nil, err
+	}
+	t.stats.IncrDialed()
+	return c, nil
+}
+
+// interceptConn passes a dialed or accepted connection through the connection interceptors.
+// If one of them returns an error, the connection is closed.
+func (t *transport) interceptConn(c tpt.CapableConn) (tpt.CapableConn, error) {
+	for _, intercept := range t.connInterceptors {
+		wrapped, err := intercept(c)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		c = wrapped
+	}
+	return c, nil
+}
+
+// countStreams updates the number of open streams, and reports it to the stats collector.
+func (t *transport) countStreams(delta int) {
+	t.stats.RecordStreamCount(int(atomic.AddInt32(&t.numStreams, int32(delta))))
+}
+
+// logDial passes the outcome of a dial to the connection logger, if one is configured.
+func (t *transport) logDial(p peer.ID, raddr ma.Multiaddr, err error) {
+	if t.connLogger == nil {
+		return
+	}
+	// raddr might not contain an IP address, if it was looked up in the address book
+	addr, _ := fromQuicMultiaddr(raddr)
+	t.connLogger(p, addr, network.DirOutbound, err)
+}
+
+// logAccept passes the outcome of accepting a connection to the connection logger, if one is configured.
+func (t *transport) logAccept(p peer.ID, raddr net.Addr, err error) {
+	if t.connLogger != nil {
+		t.connLogger(p, raddr, network.DirInbound, err)
+	}
+}
+
+// addPendingDial registers a dial in progress.
+// It returns ErrTooManyPendingDials if the limit of pending dials to the peer is reached.
+func (t *transport) addPendingDial(key dialKey, cancel context.CancelFunc) (*pendingDial, error) {
+	t.pendingDialsMutex.Lock()
+	defer t.pendingDialsMutex.Unlock()
+
+	if t.maxPendingDialsPerPeer > 0 && t.numPendingDials[key.peer] >= t.maxPendingDialsPerPeer {
+		return nil, ErrTooManyPendingDials
+	}
+	t.numPendingDials[key.peer]++
+	pd := &pendingDial{cancel: cancel}
+	t.pendingDials[key] = append(t.pendingDials[key], pd)
+	return pd, nil
+}
+
+func (t *transport) removePendingDial(key dialKey, pd *pendingDial) {
+	t.pendingDialsMutex.Lock()
+	defer t.pendingDialsMutex.Unlock()
+
+	if t.numPendingDials[key.peer]--; t.numPendingDials[key.peer] == 0 {
+		delete(t.numPendingDials, key.peer)
+	}
+
+	dials := t.pendingDials[key]
+	for i, d := range dials {
+		if d == pd {
+			dials = append(dials[:i], dials[i+1:]...)
+			break
+		}
+	}
+	if len(dials) == 0 {
+		delete(t.pendingDials, key)
+		return
+	}
+	t.pendingDials[key] = dials
+}
+
+// CancelDial cancels all dials to peer p on address raddr that are in progress.
+// The canceled Dial calls return an error wrapping ErrDialCancelled and context.Canceled.
+// It returns the number of dials that were canceled.
+func (t *transport) CancelDial(p peer.ID, raddr ma.Multiaddr) int {
+	t.pendingDialsMutex.Lock()
+	defer t.pendingDialsMutex.Unlock()
+
+	dials := t.pendingDials[dialKey{peer: p, addr: raddr.String()}]
+	for _, d := range dials {
+		d.cancel()
+	}
+	return len(dials)
+}
+
+// dialWithRetries dials, and retries temporary failures as configured by WithRetryBudget.
+// The backoff between attempts doubles after every attempt, and is jittered.
+func (t *transport) dialWithRetries(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (tpt.CapableConn, error) {
+	backoff := t.retryBackoff
+	for attempt := 1; ; attempt++ {
+		c, err := t.dial(ctx, raddr, p)
+		if err == nil || attempt >= t.retryAttempts || ctx.Err() != nil || !isTemporaryDialError(err) {
+			return c, err
+		}
+		timer := time.NewTimer(backoff/2 + time.Duration(mrand.Int63n(int64(backoff/2)+1)))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, &dialCancelledError{err: ctx.Err()}
+		}
+		backoff *= 2
+		if backoff > t.retryMaxBackoff {
+			backoff = t.retryMaxBackoff
+		}
+	}
+}
+
+// isTemporaryDialError says if a dial failed for a reason that might go away when retrying.
+func isTemporaryDialError(err error) bool {
+	// The handshake timed out. Callers check if the dial context was canceled.
+	if _, ok := err.(*dialCancelledError); ok {
+		return true
+	}
+	nerr, ok := err.(net.Error)
+	return ok && (nerr.Temporary() || nerr.Timeout())
+}
+
+// WarmUp dials a peer, and keeps the connection until Dial is called for the same peer and address.
+// If there's already a warm connection to the peer and address, WarmUp doesn't dial again.
+func (t *transport) WarmUp(ctx context.Context, p peer.ID, raddr ma.Multiaddr) error {
+	key := dialKey{peer: p, addr: raddr.String()}
+	t.warmConnsMutex.Lock()
+	c, ok := t.warmConns[key]
+	t.warmConnsMutex.Unlock()
+	if ok && !c.IsClosed() {
+		return nil
+	}
+
+	c, err := t.dial(ctx, raddr, p)
+	t.logDial(p, raddr, err)
+	if err != nil {
+		t.stats.IncrDialError()
+		return err
+	}
+	t.warmConnsMutex.Lock()
+	if existing, ok := t.warmConns[key]; ok && !existing.IsClosed() {
+		// another call to WarmUp was faster
+		t.warmConnsMutex.Unlock()
+		return c.Close()
+	}
+	t.warmConns[key] = c
+	t.warmConnsMutex.Unlock()
+	return nil
+}
+
+// takeWarmConn removes the connection to peer p and address raddr established by WarmUp
+// from the warm connections, and returns it. It returns nil if there's no such connection.
+func (t *transport) takeWarmConn(p peer.ID, raddr ma.Multiaddr) *conn {
+	key := dialKey{peer: p, addr: raddr.String()}
+	t.warmConnsMutex.Lock()
+	defer t.warmConnsMutex.Unlock()
+
+	c, ok := t.warmConns[key]
+	if !ok {
+		return nil
+	}
+	delete(t.warmConns, key)
+	if c.IsClosed() {
+		return nil
+	}
+	return c
+}
+
+// closeWarmConnsTo closes all connections to peer p established by WarmUp.
+func (t *transport) closeWarmConnsTo(p peer.ID) {
+	t.warmConnsMutex.Lock()
+	defer t.warmConnsMutex.Unlock()
+
+	for key, c := range t.warmConns {
+		if key.peer == p {
+			c.Close()
+			delete(t.warmConns, key)
+		}
+	}
+}
+
+func (t *transport) closeWarmConns() {
+	t.warmConnsMutex.Lock()
+	defer t.warmConnsMutex.Unlock()
+
+	for key, c := range t.warmConns {
+		c.Close()
+		delete(t.warmConns, key)
+	}
+}
+
+// DialAsync dials a peer in the background.
+// The result is sent on the returned channel once the dial completed.
+func (t *transport) DialAsync(ctx context.Context, raddr ma.Multiaddr, p peer.ID) <-chan DialResult {
+	resChan := make(chan DialResult, 1)
+	go func() {
+		conn, err := t.Dial(ctx, raddr, p)
+		resChan <- DialResult{Conn: conn, Err: err}
+	}()
+	return resChan
+}
+
+func (t *transport) dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (*conn, error) {
+	if t.isBlacklisted(p) {
+		return nil, ErrPeerBlacklisted
+	}
+	if isPeerIDMultiaddr(raddr) {
+		var err error
+		raddr, err = t.lookupAddr(raddr, p)
+		if err != nil {
+			return nil, err
+		}
+	}
+	trace := DialTraceFromContext(ctx)
+	if trace == nil {
+		trace = &DialTrace{}
+	}
 	network, host, err := manet.DialArgs(raddr)
 	if err != nil {
 		return nil, err
@@ -118,55 +662,293 @@ func (t *transport) Dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (tp
 	if err != nil {
 		return nil, err
 	}
+	trace.AddrResolved = time.Now()
 	addr, err := fromQuicMultiaddr(raddr)
 	if err != nil {
 		return nil, err
 	}
 	tlsConf, keyCh := t.identity.ConfigForPeer(p)
-	pconn, err := t.connManager.Dial(network, udpAddr)
+	var pconn dialConn
+	if t.contextDialer != nil {
+		var c net.Conn
+		c, err = t.contextDialer(ctx, host)
+		if err == nil {
+			pconn = &noreuseConn{Conn: c}
+		}
+	} else if port, ok := sourcePortFromContext(ctx); ok {
+		pconn, err = t.connManager.DialFromPort(network, udpAddr, port)
+	} else {
+		pconn, err = t.connManager.Dial(network, udpAddr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	localMultiaddr, err := toQuicMultiaddr(dialLocalAddr(pconn.LocalAddr(), udpAddr))
 	if err != nil {
+		pconn.DecreaseCount()
 		return nil, err
 	}
-	sess, err := quic.DialContext(ctx, pconn, addr, host, tlsConf, quicConfig)
+	trace.SocketAcquired = time.Now()
+	if _, ok := ctx.Deadline(); !ok && t.handshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.handshakeTimeout)
+		defer cancel()
+	}
+	trace.HandshakeStarted = time.Now()
+	sess, err := quicDialContext(ctx, pconn, addr, host, tlsConf, t.quicConfig)
 	if err != nil {
 		pconn.DecreaseCount()
+		if ctx.Err() != nil {
+			return nil, &dialCancelledError{err: ctx.Err()}
+		}
 		return nil, err
 	}
-	// Should be ready by this point, don't block.
+	trace.HandshakeCompleted = time.Now()
+	t.stats.RecordHandshakeDuration(trace.HandshakeCompleted.Sub(trace.HandshakeStarted))
 	var remotePubKey ic.PubKey
-	select {
-	case remotePubKey = <-keyCh:
-	default:
+	if t.keyExchangeTimeout > 0 {
+		timer := time.NewTimer(t.keyExchangeTimeout)
+		select {
+		case remotePubKey = <-keyCh:
+			timer.Stop()
+		case <-timer.C:
+			sess.CloseWithError(0, "")
+			pconn.DecreaseCount()
+			return nil, ErrKeyExchangeTimeout
+		}
+	} else {
+		// Should be ready by this point, don't block.
+		select {
+		case remotePubKey = <-keyCh:
+		default:
+		}
 	}
 	if remotePubKey == nil {
+		sess.CloseWithError(0, "")
 		pconn.DecreaseCount()
 		return nil, errors.New("go-libp2p-quic-transport BUG: expected remote pub key to be set")
 	}
+	if t.peerIDVerifier != nil {
+		if err := t.peerIDVerifier(p); err != nil {
+			sess.CloseWithError(0, err.Error())
+			pconn.DecreaseCount()
+			return nil, err
+		}
+	}
+	if !t.addSession() {
+		sess.CloseWithError(0, ErrTransportClosed.Error())
+		pconn.DecreaseCount()
+		return nil, ErrTransportClosed
+	}
+	if rconn, ok := pconn.(*reuseConn); ok {
+		rconn.AddSession(sess.Context())
+	}
 	go func() {
 		<-sess.Context().Done()
 		pconn.DecreaseCount()
+		t.sessions.Done()
 	}()
+	trace.ConnReady = time.Now()
+
+	return &conn{
+		id:                newConnID(),
+		sess:              sess,
+		transport:         t,
+		streamObserver:    t.streamObserver,
+		streamErrorMapper: t.streamErrorMapper,
+		countStreams:      t.countStreams,
+		privKey:           t.privKey,
+		localPeer:         t.localPeer,
+		localMultiaddr:    localMultiaddr,
+		remotePubKey:      remotePubKey,
+		remotePeerID:      p,
+		remoteMultiaddr:   raddr,
+	}, nil
+}
+
+// dialLocalAddr returns the local address of a connection dialed from a socket bound to laddr to raddr.
+// Dual-stack sockets are bound to the IPv6 unspecified address, even if they're used for IPv4 traffic.
+// For IPv4 remote addresses, the IPv4 unspecified address is returned instead.
+func dialLocalAddr(laddr net.Addr, raddr *net.UDPAddr) net.Addr {
+	udpAddr, ok := laddr.(*net.UDPAddr)
+	if !ok || raddr.IP.To4() == nil || !udpAddr.IP.Equal(net.IPv6unspecified) {
+		return laddr
+	}
+	return &net.UDPAddr{IP: net.IPv4zero, Port: udpAddr.Port}
+}
+
+// BlacklistPeer prevents connections to and from peer p.
+// Dials to p fail with ErrPeerBlacklisted, and connections accepted from p are closed.
+// Connections to p established by WarmUp are closed, other existing connections are not affected.
+func (t *transport) BlacklistPeer(p peer.ID) {
+	t.blacklist.Store(p, struct{}{})
+	t.closeWarmConnsTo(p)
+}
+
+// UnblacklistPeer removes peer p from the blacklist.
+func (t *transport) UnblacklistPeer(p peer.ID) {
+	t.blacklist.Delete(p)
+}
+
+func (t *transport) isBlacklisted(p peer.ID) bool {
+	_, ok := t.blacklist.Load(p)
+	return ok
+}
 
-	localMultiaddr, err := toQuicMultiaddr(pconn.LocalAddr())
+// isPeerIDMultiaddr says if addr only consists of a peer ID (/ipfs/<peer ID>).
+func isPeerIDMultiaddr(addr ma.Multiaddr) bool {
+	protos := addr.Protocols()
+	return len(protos) == 1 && protos[0].Code == ma.P_IPFS
+}
+
+// lookupAddr looks up a dialable address for peer p in the address book.
+// addr must be a multiaddr that only consists of p's peer ID.
+func (t *transport) lookupAddr(addr ma.Multiaddr, p peer.ID) (ma.Multiaddr, error) {
+	if t.addrBook == nil {
+		return nil, errors.New("can't dial a peer ID without an address book")
+	}
+	value, err := addr.ValueForProtocol(ma.P_IPFS)
 	if err != nil {
-		pconn.DecreaseCount()
 		return nil, err
 	}
-	return &conn{
-		sess:            sess,
-		transport:       t,
-		privKey:         t.privKey,
-		localPeer:       t.localPeer,
-		localMultiaddr:  localMultiaddr,
-		remotePubKey:    remotePubKey,
-		remotePeerID:    p,
-		remoteMultiaddr: raddr,
-	}, nil
+	id, err := peer.IDB58Decode(value)
+	if err != nil {
+		return nil, err
+	}
+	if id != p {
+		return nil, fmt.Errorf("peer ID mismatch: dialing %s, but address contains %s", p.Pretty(), id.Pretty())
+	}
+	for _, a := range t.addrBook.Addrs(p) {
+		if dialMatcher.Matches(a) {
+			return a, nil
+		}
+	}
+	return nil, fmt.Errorf("no QUIC address found for peer %s", p.Pretty())
+}
+
+// addSession counts a session until sessions.Done is called.
+// It returns false if the transport was closed. In that case, the session must be closed.
+func (t *transport) addSession() bool {
+	t.closeMutex.Lock()
+	defer t.closeMutex.Unlock()
+
+	if t.closed {
+		return false
+	}
+	t.sessions.Add(1)
+	return true
+}
+
+// markClosed makes addSession fail. Once it returned, it's safe to wait for sessions.
+func (t *transport) markClosed() {
+	t.closeMutex.Lock()
+	t.closed = true
+	t.closeMutex.Unlock()
+}
+
+func (t *transport) isClosed() bool {
+	t.closeMutex.Lock()
+	defer t.closeMutex.Unlock()
+	return t.closed
+}
+
+// addConn tracks an accepted connection until its session is closed.
+// It returns false if the transport was closed. In that case, the connection must be closed.
+func (t *transport) addConn(c *conn) bool {
+	if !t.addSession() {
+		return false
+	}
+	t.connsMutex.Lock()
+	t.conns[c.remotePeerID] = append(t.conns[c.remotePeerID], c)
+	t.connsMutex.Unlock()
+
+	go func() {
+		<-c.sess.Context().Done()
+		t.removeConn(c)
+		t.sessions.Done()
+	}()
+	return true
+}
+
+func (t *transport) removeConn(c *conn) {
+	t.connsMutex.Lock()
+	defer t.connsMutex.Unlock()
+
+	conns := t.conns[c.remotePeerID]
+	for i, conn := range conns {
+		if conn == c {
+			conns = append(conns[:i], conns[i+1:]...)
+			break
+		}
+	}
+	if len(conns) == 0 {
+		delete(t.conns, c.remotePeerID)
+	} else {
+		t.conns[c.remotePeerID] = conns
+	}
+}
+
+// ConnsToPeer returns the connections to peer p that were accepted by this transport's listeners.
+func (t *transport) ConnsToPeer(p peer.ID) []tpt.CapableConn {
+	t.connsMutex.RLock()
+	defer t.connsMutex.RUnlock()
+
+	conns := make([]tpt.CapableConn, 0, len(t.conns[p]))
+	for _, c := range t.conns[p] {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// ClosePeer closes all connections to peer p that were accepted by this transport's listeners.
+func (t *transport) ClosePeer(p peer.ID) error {
+	var firstErr error
+	for _, c := range t.ConnsToPeer(p) {
+		if err := c.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// DrainPeer gracefully closes all connections to peer p that were accepted by this transport's listeners.
+// The connections stop opening and accepting new streams. Once all of their streams are closed or reset,
+// or once the context is done, the connections are closed.
+// If the context is done first, the context's error is returned.
+func (t *transport) DrainPeer(ctx context.Context, p peer.ID) error {
+	t.connsMutex.RLock()
+	conns := append([]*conn(nil), t.conns[p]...)
+	t.connsMutex.RUnlock()
+
+	drained := make([]<-chan struct{}, 0, len(conns))
+	for _, c := range conns {
+		drained = append(drained, c.drain())
+	}
+	var firstErr error
+loop:
+	for _, d := range drained {
+		select {
+		case <-d:
+		case <-ctx.Done():
+			firstErr = ctx.Err()
+			break loop
+		}
+	}
+	for _, c := range conns {
+		if err := c.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
 }
 
 // CanDial determines if we can dial to an address
+// If an address book is set, this includes multiaddrs that only contain a peer ID.
 func (t *transport) CanDial(addr ma.Multiaddr) bool {
-	return mafmt.QUIC.Matches(addr)
+	if t.addrBook != nil && isPeerIDMultiaddr(addr) {
+		return true
+	}
+	return dialMatcher.Matches(addr)
 }
 
 // Listen listens for new QUIC connections on the passed multiaddr.
@@ -186,6 +968,47 @@ func (t *transport) Listen(addr ma.Multiaddr) (tpt.Listener, error) {
 	return newListener(conn, t, t.localPeer, t.privKey, t.identity)
 }
 
+// Close closes all UDP sockets used by the transport, without waiting for connections to be closed.
+// Connections established by WarmUp that weren't returned by Dial yet are closed.
+// Once closed, Dial returns ErrTransportClosed, and listeners reject new connections.
+// It returns the first error encountered.
+func (t *transport) Close() error {
+	t.markClosed()
+	t.closeWarmConns()
+	return t.connManager.Close()
+}
+
+// CloseContext closes the connections established by WarmUp that weren't returned by Dial yet.
+// It then waits until all other dialed and accepted connections are closed,
+// or until the context is done, and then closes all UDP sockets used by the transport.
+// If the context is done before all connections are closed, the context's error is returned.
+// Once CloseContext was called, Dial returns ErrTransportClosed, and listeners reject new connections.
+func (t *transport) CloseContext(ctx context.Context) error {
+	t.markClosed()
+	// Connections established by WarmUp are not in use yet.
+	t.closeWarmConns()
+	done := make(chan struct{})
+	go func() {
+		t.sessions.Wait()
+		close(done)
+	}()
+	var ctxErr error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		ctxErr = ctx.Err()
+	}
+	if err := t.Close(); err != nil && ctxErr == nil {
+		return err
+	}
+	return ctxErr
+}
+
+// LocalPeerID returns the peer ID of the local node.
+func (t *transport) LocalPeerID() peer.ID {
+	return t.localPeer
+}
+
 // Proxy returns true if this transport proxies.
 func (t *transport) Proxy() bool {
 	return false
@@ -197,5 +1020,5 @@ func (t *transport) Protocols() []int {
 }
 
 func (t *transport) String() string {
-	return "QUIC"
+	return "QUIC/" + t.localPeer.Pretty()
 }
@@ -0,0 +1,37 @@
+package libp2pquic
+
+import (
+	"context"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// TransportInfo describes the transport that handles an operation.
+type TransportInfo struct {
+	// LocalPeer is the peer ID of the transport.
+	LocalPeer peer.ID
+	// Transport is the string representation of the transport.
+	Transport string
+	// Created is the time the transport was created.
+	Created time.Time
+}
+
+type transportInfoKey struct{}
+
+// InjectTransportContext returns a context that carries information about this transport.
+// It can be retrieved using TransportFromContext, e.g. by code called from within Dial.
+func (t *transport) InjectTransportContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, transportInfoKey{}, TransportInfo{
+		LocalPeer: t.localPeer,
+		Transport: t.String(),
+		Created:   t.created,
+	})
+}
+
+// TransportFromContext returns the TransportInfo set by InjectTransportContext.
+// The second return value is false if there is none.
+func TransportFromContext(ctx context.Context) (TransportInfo, bool) {
+	info, ok := ctx.Value(transportInfoKey{}).(TransportInfo)
+	return info, ok
+}
@@ -1,13 +1,52 @@
 package libp2pquic
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
 	tpt "github.com/libp2p/go-libp2p-core/transport"
+	quic "github.com/lucas-clemente/quic-go"
 	ma "github.com/multiformats/go-multiaddr"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
 
+type fakeAddr struct{}
+
+func (fakeAddr) Network() string { return "fake" }
+func (fakeAddr) String() string  { return "fake" }
+
+// A fakeLocalAddrPacketConn has a local address that can't be converted to a multiaddr.
+type fakeLocalAddrPacketConn struct {
+	net.PacketConn
+}
+
+func (c *fakeLocalAddrPacketConn) LocalAddr() net.Addr { return fakeAddr{} }
+func (c *fakeLocalAddrPacketConn) Close() error        { return nil }
+
+// A temporaryError is a net.Error that is temporary.
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "temporary error" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+type mockAddrBook struct {
+	peerstore.AddrBook
+	addrs map[peer.ID][]ma.Multiaddr
+}
+
+func (b *mockAddrBook) Addrs(p peer.ID) []ma.Multiaddr { return b.addrs[p] }
+
 var _ = Describe("Transport", func() {
 	var t tpt.Transport
 
@@ -24,9 +63,485 @@ var _ = Describe("Transport", func() {
 		Expect(t.CanDial(validAddr)).To(BeTrue())
 	})
 
+	It("says that it can dial scoped IPv6 addresses", func() {
+		addr, err := ma.NewMultiaddr("/ip6zone/eth0/ip6/fe80::1/udp/1234/quic")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(t.CanDial(addr)).To(BeTrue())
+	})
+
 	It("supports the QUIC protocol", func() {
 		protocols := t.Protocols()
 		Expect(protocols).To(HaveLen(1))
 		Expect(protocols[0]).To(Equal(ma.P_QUIC))
 	})
+
+	It("returns the local peer ID", func() {
+		key, _, err := ic.GenerateEd25519Key(rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		id, err := peer.IDFromPrivateKey(key)
+		Expect(err).ToNot(HaveOccurred())
+		tr, err := NewTransport(key)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(tr.(QUICTransport).LocalPeerID()).To(Equal(id))
+	})
+
+	It("includes the local peer ID in its string representation", func() {
+		key, _, err := ic.GenerateEd25519Key(rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		id, err := peer.IDFromPrivateKey(key)
+		Expect(err).ToNot(HaveOccurred())
+		tr, err := NewTransport(key)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(tr.(*transport).String()).To(Equal("QUIC/" + id.Pretty()))
+	})
+
+	Context("configuring", func() {
+		var key ic.PrivKey
+
+		BeforeEach(func() {
+			var err error
+			key, _, err = ic.GenerateEd25519Key(rand.Reader)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("sets the stream limits", func() {
+			tr, err := NewTransport(key, WithStreamLimits(10, 5))
+			Expect(err).ToNot(HaveOccurred())
+			conf := tr.(*transport).quicConfig
+			Expect(conf.MaxIncomingStreams).To(Equal(10))
+			Expect(conf.MaxIncomingUniStreams).To(Equal(5))
+			// the default config is not modified
+			Expect(quicConfig.MaxIncomingStreams).To(Equal(1000))
+			Expect(quicConfig.MaxIncomingUniStreams).To(Equal(-1))
+		})
+
+		It("rejects invalid stream limits", func() {
+			_, err := NewTransport(key, WithStreamLimits(-1, 0))
+			Expect(err).To(MatchError("the number of bidirectional streams must not be negative"))
+			_, err = NewTransport(key, WithStreamLimits(0, -2))
+			Expect(err).To(MatchError("the number of unidirectional streams must be at least -1"))
+		})
+
+		It("rejects a negative handshake timeout", func() {
+			_, err := NewTransport(key, WithHandshakeTimeout(-time.Second))
+			Expect(err).To(MatchError("handshake timeout must not be negative"))
+		})
+
+		It("disables keep-alives", func() {
+			tr, err := NewTransport(key)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tr.(*transport).quicConfig.KeepAlive).To(BeTrue())
+			tr, err = NewTransport(key, WithDisableKeepAlive())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tr.(*transport).quicConfig.KeepAlive).To(BeFalse())
+			// the default config is not modified
+			Expect(quicConfig.KeepAlive).To(BeTrue())
+		})
+
+		It("sets the receive windows", func() {
+			tr, err := NewTransport(key, WithMaxStreamReceiveWindow(1<<20), WithMaxConnectionReceiveWindow(2<<20))
+			Expect(err).ToNot(HaveOccurred())
+			conf := tr.(*transport).quicConfig
+			Expect(conf.MaxReceiveStreamFlowControlWindow).To(BeEquivalentTo(1 << 20))
+			Expect(conf.MaxReceiveConnectionFlowControlWindow).To(BeEquivalentTo(2 << 20))
+			// the default config is not modified
+			Expect(quicConfig.MaxReceiveStreamFlowControlWindow).To(BeEquivalentTo(3 << 20))
+			Expect(quicConfig.MaxReceiveConnectionFlowControlWindow).To(BeEquivalentTo(4.5 * (1 << 20)))
+		})
+
+		It("sets a custom stateless reset key", func() {
+			var resetKey [32]byte
+			for i := range resetKey {
+				resetKey[i] = byte(i)
+			}
+			tr, err := NewTransport(key, WithCustomStatelessResetKey(resetKey))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tr.(*transport).quicConfig.StatelessResetKey).To(Equal(resetKey[:]))
+			// the default config is not modified
+			Expect(quicConfig.StatelessResetKey).To(BeNil())
+		})
+
+		It("applies QUIC config mutators in order", func() {
+			tr, err := NewTransport(key,
+				WithQUICConfigMutator(func(conf *quic.Config) { conf.IdleTimeout = time.Minute }),
+				WithQUICConfigMutator(func(conf *quic.Config) { conf.IdleTimeout *= 2 }),
+			)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tr.(*transport).quicConfig.IdleTimeout).To(Equal(2 * time.Minute))
+			// the default config is not modified
+			Expect(quicConfig.IdleTimeout).To(BeZero())
+		})
+
+		It("rejects a connection receive window smaller than the stream receive window", func() {
+			_, err := NewTransport(key, WithMaxConnectionReceiveWindow(1<<20))
+			Expect(err).To(MatchError("the connection receive window must not be smaller than the stream receive window"))
+			_, err = NewTransport(key, WithMaxConnectionReceiveWindow(1<<20), WithMaxStreamReceiveWindow(1<<20))
+			Expect(err).ToNot(HaveOccurred())
+			_, err = NewTransport(key, WithMaxStreamReceiveWindow(0))
+			Expect(err).To(MatchError("the stream receive window must be positive"))
+		})
+	})
+
+	Context("dialing", func() {
+		var (
+			key                 ic.PrivKey
+			id                  peer.ID
+			raddr               ma.Multiaddr
+			origQuicDialContext = quicDialContext
+		)
+
+		BeforeEach(func() {
+			var err error
+			key, _, err = ic.GenerateEd25519Key(rand.Reader)
+			Expect(err).ToNot(HaveOccurred())
+			id, err = peer.IDFromPrivateKey(key)
+			Expect(err).ToNot(HaveOccurred())
+			raddr, err = ma.NewMultiaddr("/ip4/127.0.0.1/udp/1234/quic")
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			quicDialContext = origQuicDialContext
+		})
+
+		It("uses the handshake timeout if the context doesn't have a deadline", func() {
+			quicDialContext = func(ctx context.Context, _ net.PacketConn, _ net.Addr, _ string, _ *tls.Config, _ *quic.Config) (quic.Session, error) {
+				select {
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				case <-time.After(200 * time.Millisecond):
+					return nil, errors.New("handshake didn't time out")
+				}
+			}
+			tr, err := NewTransport(key, WithGarbageCollectInterval(testGarbageCollectInterval), WithHandshakeTimeout(50*time.Millisecond))
+			Expect(err).ToNot(HaveOccurred())
+			_, err = tr.Dial(context.Background(), raddr, id)
+			Expect(errors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+		})
+
+		It("uses the connect timeout", func() {
+			quicDialContext = func(ctx context.Context, _ net.PacketConn, _ net.Addr, _ string, _ *tls.Config, _ *quic.Config) (quic.Session, error) {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}
+			tr, err := NewTransport(key, WithGarbageCollectInterval(testGarbageCollectInterval), WithConnectTimeout(100*time.Millisecond))
+			Expect(err).ToNot(HaveOccurred())
+			ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+			defer cancel()
+			start := time.Now()
+			_, err = tr.Dial(ctx, raddr, id)
+			Expect(errors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+			Expect(time.Since(start)).To(And(
+				BeNumerically(">=", 100*time.Millisecond),
+				BeNumerically("<", 200*time.Millisecond),
+			))
+		})
+
+		It("retries temporary dial failures", func() {
+			serverTransport, err := NewTransport(key, WithGarbageCollectInterval(testGarbageCollectInterval))
+			Expect(err).ToNot(HaveOccurred())
+			laddr, err := ma.NewMultiaddr("/ip4/127.0.0.1/udp/0/quic")
+			Expect(err).ToNot(HaveOccurred())
+			ln, err := serverTransport.Listen(laddr)
+			Expect(err).ToNot(HaveOccurred())
+			defer ln.Close()
+			accepted := make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				defer close(accepted)
+				conn, err := ln.Accept()
+				Expect(err).ToNot(HaveOccurred())
+				conn.Close()
+			}()
+
+			var attempts int32
+			quicDialContext = func(ctx context.Context, pconn net.PacketConn, remoteAddr net.Addr, host string, tlsConf *tls.Config, conf *quic.Config) (quic.Session, error) {
+				if atomic.AddInt32(&attempts, 1) <= 2 {
+					return nil, temporaryError{}
+				}
+				return origQuicDialContext(ctx, pconn, remoteAddr, host, tlsConf, conf)
+			}
+			clientKey, _, err := ic.GenerateEd25519Key(rand.Reader)
+			Expect(err).ToNot(HaveOccurred())
+			tr, err := NewTransport(clientKey,
+				WithGarbageCollectInterval(testGarbageCollectInterval),
+				WithRetryBudget(3, 10*time.Millisecond, 20*time.Millisecond),
+			)
+			Expect(err).ToNot(HaveOccurred())
+			conn, err := tr.Dial(context.Background(), ln.Multiaddr(), id)
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+			Expect(atomic.LoadInt32(&attempts)).To(BeEquivalentTo(3))
+			Eventually(accepted).Should(BeClosed())
+		})
+
+		It("doesn't retry more often than the retry budget allows", func() {
+			var attempts int32
+			quicDialContext = func(context.Context, net.PacketConn, net.Addr, string, *tls.Config, *quic.Config) (quic.Session, error) {
+				atomic.AddInt32(&attempts, 1)
+				return nil, temporaryError{}
+			}
+			tr, err := NewTransport(key,
+				WithGarbageCollectInterval(testGarbageCollectInterval),
+				WithRetryBudget(2, 10*time.Millisecond, 20*time.Millisecond),
+			)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = tr.Dial(context.Background(), raddr, id)
+			Expect(err).To(MatchError(temporaryError{}))
+			Expect(atomic.LoadInt32(&attempts)).To(BeEquivalentTo(2))
+		})
+
+		It("doesn't retry permanent dial failures", func() {
+			var attempts int32
+			quicDialContext = func(context.Context, net.PacketConn, net.Addr, string, *tls.Config, *quic.Config) (quic.Session, error) {
+				atomic.AddInt32(&attempts, 1)
+				return nil, errors.New("permanent failure")
+			}
+			tr, err := NewTransport(key,
+				WithGarbageCollectInterval(testGarbageCollectInterval),
+				WithRetryBudget(3, 10*time.Millisecond, 20*time.Millisecond),
+			)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = tr.Dial(context.Background(), raddr, id)
+			Expect(err).To(MatchError("permanent failure"))
+			Expect(atomic.LoadInt32(&attempts)).To(BeEquivalentTo(1))
+		})
+
+		It("counts the UDP sockets", func() {
+			tr, err := NewTransport(key, WithGarbageCollectInterval(testGarbageCollectInterval))
+			Expect(err).ToNot(HaveOccurred())
+			connManager := tr.(*transport).connManager
+			addr4, err := ma.NewMultiaddr("/ip4/127.0.0.1/udp/0/quic")
+			Expect(err).ToNot(HaveOccurred())
+			ln4, err := tr.Listen(addr4)
+			Expect(err).ToNot(HaveOccurred())
+			addr6, err := ma.NewMultiaddr("/ip6/::1/udp/0/quic")
+			Expect(err).ToNot(HaveOccurred())
+			ln6, err := tr.Listen(addr6)
+			Expect(err).ToNot(HaveOccurred())
+			udp4, udp6 := connManager.NumConns()
+			Expect(udp4).To(Equal(1))
+			Expect(udp6).To(Equal(1))
+
+			Expect(ln4.Close()).To(Succeed())
+			Expect(ln6.Close()).To(Succeed())
+			Eventually(func() int {
+				udp4, udp6 := connManager.NumConns()
+				return udp4 + udp6
+			}).Should(BeZero())
+		})
+
+		It("releases the connection if its local address can't be converted to a multiaddr", func() {
+			tr, err := NewTransport(key, WithGarbageCollectInterval(testGarbageCollectInterval))
+			Expect(err).ToNot(HaveOccurred())
+			reuse := tr.(*transport).connManager.reuseUDP4
+			pconn := newReuseConn(&fakeLocalAddrPacketConn{})
+			reuse.mutex.Lock()
+			reuse.global[1234] = pconn
+			reuse.mutex.Unlock()
+
+			_, err = tr.Dial(context.Background(), raddr, id)
+			Expect(err).To(HaveOccurred())
+			Expect(pconn.GetCount()).To(BeZero())
+		})
+
+		It("returns ErrDialCancelled when the context is canceled", func() {
+			quicDialContext = func(ctx context.Context, _ net.PacketConn, _ net.Addr, _ string, _ *tls.Config, _ *quic.Config) (quic.Session, error) {
+				<-ctx.Done()
+				return nil, errors.New("handshake aborted")
+			}
+			tr, err := NewTransport(key, WithGarbageCollectInterval(testGarbageCollectInterval))
+			Expect(err).ToNot(HaveOccurred())
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(50*time.Millisecond, cancel)
+			_, err = tr.Dial(ctx, raddr, id)
+			Expect(errors.Is(err, ErrDialCancelled)).To(BeTrue())
+			Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+		})
+
+		It("makes the transport info available in the dial path", func() {
+			infoChan := make(chan TransportInfo, 1)
+			quicDialContext = func(ctx context.Context, _ net.PacketConn, _ net.Addr, _ string, _ *tls.Config, _ *quic.Config) (quic.Session, error) {
+				info, ok := TransportFromContext(ctx)
+				Expect(ok).To(BeTrue())
+				infoChan <- info
+				return nil, errors.New("dial failed")
+			}
+			before := time.Now()
+			tr, err := NewTransport(key, WithGarbageCollectInterval(testGarbageCollectInterval))
+			Expect(err).ToNot(HaveOccurred())
+			_, ok := TransportFromContext(context.Background())
+			Expect(ok).To(BeFalse())
+			ctx := tr.(QUICTransport).InjectTransportContext(context.Background())
+			_, err = tr.Dial(ctx, raddr, id)
+			Expect(err).To(MatchError("dial failed"))
+			var info TransportInfo
+			Expect(infoChan).To(Receive(&info))
+			Expect(info.LocalPeer).To(Equal(id))
+			Expect(info.Transport).To(Equal(tr.(*transport).String()))
+			Expect(info.Created).To(BeTemporally(">=", before))
+			Expect(info.Created).To(BeTemporally("<=", time.Now()))
+		})
+
+		It("times out waiting for the peer's public key", func() {
+			sess := &mockSession{}
+			quicDialContext = func(context.Context, net.PacketConn, net.Addr, string, *tls.Config, *quic.Config) (quic.Session, error) {
+				// the TLS handshake never ran, so the key is never sent
+				return sess, nil
+			}
+			tr, err := NewTransport(key, WithGarbageCollectInterval(testGarbageCollectInterval), WithKeyExchangeTimeout(50*time.Millisecond))
+			Expect(err).ToNot(HaveOccurred())
+			start := time.Now()
+			_, err = tr.Dial(context.Background(), raddr, id)
+			Expect(err).To(MatchError(ErrKeyExchangeTimeout))
+			Expect(time.Since(start)).To(BeNumerically(">=", 50*time.Millisecond))
+			Expect(atomic.LoadInt32(&sess.closeCount)).To(BeEquivalentTo(1))
+			// the UDP socket is released
+			Eventually(func() int {
+				udp4, _ := tr.(*transport).connManager.NumConns()
+				return udp4
+			}).Should(BeZero())
+		})
+
+		It("cancels pending dials", func() {
+			quicDialContext = func(ctx context.Context, _ net.PacketConn, _ net.Addr, _ string, _ *tls.Config, _ *quic.Config) (quic.Session, error) {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}
+			tr, err := NewTransport(key, WithGarbageCollectInterval(testGarbageCollectInterval))
+			Expect(err).ToNot(HaveOccurred())
+			errChan := make(chan error, 1)
+			go func() {
+				_, err := tr.Dial(context.Background(), raddr, id)
+				errChan <- err
+			}()
+			otherAddr, err := ma.NewMultiaddr("/ip4/127.0.0.1/udp/1235/quic")
+			Expect(err).ToNot(HaveOccurred())
+			Eventually(func() int { return tr.(QUICTransport).CancelDial(id, raddr) }).Should(Equal(1))
+			Expect(tr.(QUICTransport).CancelDial(id, otherAddr)).To(BeZero())
+			Eventually(errChan).Should(Receive(&err))
+			Expect(errors.Is(err, ErrDialCancelled)).To(BeTrue())
+			Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+			Expect(tr.(QUICTransport).CancelDial(id, raddr)).To(BeZero())
+		})
+
+		It("limits the number of pending dials per peer", func() {
+			quicDialContext = func(ctx context.Context, _ net.PacketConn, _ net.Addr, _ string, _ *tls.Config, _ *quic.Config) (quic.Session, error) {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}
+			tr, err := NewTransport(key, WithGarbageCollectInterval(testGarbageCollectInterval), WithMaxPendingDialsPerPeer(2))
+			Expect(err).ToNot(HaveOccurred())
+			errChan := make(chan error, 5)
+			for i := 0; i < 5; i++ {
+				go func() {
+					_, err := tr.Dial(context.Background(), raddr, id)
+					errChan <- err
+				}()
+			}
+			for i := 0; i < 3; i++ {
+				var err error
+				Eventually(errChan).Should(Receive(&err))
+				Expect(err).To(MatchError(ErrTooManyPendingDials))
+			}
+			Consistently(errChan).ShouldNot(Receive())
+			Expect(tr.(QUICTransport).CancelDial(id, raddr)).To(Equal(2))
+			for i := 0; i < 2; i++ {
+				var err error
+				Eventually(errChan).Should(Receive(&err))
+				Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+			}
+			// once the pending dials returned, the peer can be dialed again
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			_, err = tr.Dial(ctx, raddr, id)
+			Expect(errors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+		})
+
+		It("releases the UDP socket when the dial is canceled", func() {
+			quicDialContext = func(ctx context.Context, _ net.PacketConn, _ net.Addr, _ string, _ *tls.Config, _ *quic.Config) (quic.Session, error) {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}
+			tr, err := NewTransport(key, WithGarbageCollectInterval(testGarbageCollectInterval))
+			Expect(err).ToNot(HaveOccurred())
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(50*time.Millisecond, cancel)
+			_, err = tr.Dial(ctx, raddr, id)
+			Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+
+			reuse := tr.(*transport).connManager.reuseUDP4
+			var conns []*reuseConn
+			reuse.mutex.Lock()
+			for _, c := range reuse.global {
+				conns = append(conns, c)
+			}
+			reuse.mutex.Unlock()
+			Expect(conns).To(HaveLen(1))
+			Expect(conns[0].GetCount()).To(BeZero())
+			// the socket is garbage collected
+			Eventually(reuse.NumConns).Should(BeZero())
+		})
+
+		Context("using an address book", func() {
+			var (
+				addrBook *mockAddrBook
+				peerAddr ma.Multiaddr
+			)
+
+			BeforeEach(func() {
+				tcpAddr, err := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/1234")
+				Expect(err).ToNot(HaveOccurred())
+				quicAddr, err := ma.NewMultiaddr("/ip4/127.0.0.1/udp/4321/quic")
+				Expect(err).ToNot(HaveOccurred())
+				addrBook = &mockAddrBook{addrs: map[peer.ID][]ma.Multiaddr{id: {tcpAddr, quicAddr}}}
+				peerAddr, err = ma.NewMultiaddr("/ipfs/" + id.Pretty())
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("says that it can dial peer IDs", func() {
+				tr, err := NewTransport(key)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(tr.CanDial(peerAddr)).To(BeFalse())
+				tr, err = NewTransport(key, WithAddrBook(addrBook))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(tr.CanDial(peerAddr)).To(BeTrue())
+			})
+
+			It("dials the first QUIC address from the address book", func() {
+				testErr := errors.New("test done")
+				remoteAddrChan := make(chan net.Addr, 1)
+				quicDialContext = func(_ context.Context, _ net.PacketConn, remoteAddr net.Addr, _ string, _ *tls.Config, _ *quic.Config) (quic.Session, error) {
+					remoteAddrChan <- remoteAddr
+					return nil, testErr
+				}
+				tr, err := NewTransport(key, WithGarbageCollectInterval(testGarbageCollectInterval), WithAddrBook(addrBook))
+				Expect(err).ToNot(HaveOccurred())
+				_, err = tr.Dial(context.Background(), peerAddr, id)
+				Expect(err).To(MatchError(testErr))
+				var remoteAddr net.Addr
+				Expect(remoteAddrChan).To(Receive(&remoteAddr))
+				Expect(remoteAddr.String()).To(Equal("127.0.0.1:4321"))
+			})
+
+			It("errors if the address book doesn't contain a QUIC address", func() {
+				tr, err := NewTransport(key, WithAddrBook(&mockAddrBook{}))
+				Expect(err).ToNot(HaveOccurred())
+				_, err = tr.Dial(context.Background(), peerAddr, id)
+				Expect(err).To(MatchError("no QUIC address found for peer " + id.Pretty()))
+			})
+
+			It("errors if the peer ID doesn't match", func() {
+				otherKey, _, err := ic.GenerateEd25519Key(rand.Reader)
+				Expect(err).ToNot(HaveOccurred())
+				otherID, err := peer.IDFromPrivateKey(otherKey)
+				Expect(err).ToNot(HaveOccurred())
+				tr, err := NewTransport(key, WithAddrBook(addrBook))
+				Expect(err).ToNot(HaveOccurred())
+				_, err = tr.Dial(context.Background(), peerAddr, otherID)
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("peer ID mismatch"))
+			})
+		})
+	})
 })